@@ -56,6 +56,7 @@ func New() *Commandeer {
 
 	c.rootCmd.PersistentFlags().StringVar(&c.cfgFile, "config", "", "config file (default is ./config.toml)")
 	c.rootCmd.AddCommand(c.newUrls().cmd)
+	c.rootCmd.AddCommand(c.newPurge().cmd)
 
 	return c
 }
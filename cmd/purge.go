@@ -0,0 +1,102 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bep/s3tlsproxy/lib/sig"
+	"github.com/spf13/cobra"
+)
+
+type purge struct {
+	cmd *cobra.Command
+
+	// Flags
+	server string
+	prefix string
+	tags   []string
+}
+
+func (c *Commandeer) newPurge() purge {
+	p := purge{}
+
+	cmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Purges cached objects by path prefix or tag",
+		Long: `Purges cached objects by path prefix or tag, e.g.
+
+  s3tlsproxy purge --server https://example.org --tag footer --tag header
+
+purges all objects for example.org tagged with footer or header.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := c.init(); err != nil {
+				return err
+			}
+
+			if p.server == "" || p.prefix == "" && len(p.tags) == 0 {
+				return errors.New("missing flag value")
+			}
+
+			q := make(url.Values)
+			if p.prefix != "" {
+				q.Set("prefix", p.prefix)
+			}
+			for _, tag := range p.tags {
+				q.Add("tag", tag)
+			}
+
+			purgeURL := strings.TrimRight(p.server, "/") + "/__s3p/purge?" + q.Encode()
+
+			signedURL, err := sig.New(c.cfg.SecretKey).SignURL(purgeURL, "GET", time.Minute)
+			if err != nil {
+				return err
+			}
+
+			resp, err := http.Get(signedURL)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("purge failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+			}
+
+			fmt.Print(string(body))
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&p.server, "server", "", "", "the proxy URL for the host, e.g. https://example.org")
+	cmd.Flags().StringVarP(&p.prefix, "prefix", "", "", "purge the objects below this path")
+	cmd.Flags().StringSliceVarP(&p.tags, "tag", "", nil, "purge the objects with this tag, can be repeated")
+
+	p.cmd = cmd
+
+	return p
+}
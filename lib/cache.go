@@ -15,23 +15,31 @@
 package lib
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/boltdb/bolt"
-
-	"github.com/asdine/storm"
 )
 
 // A header represents the key-value pairs in a HTTP header.
 type header map[string][]string
 
+func (h header) get(key string) string {
+	return http.Header(h).Get(key)
+}
+
 func (h header) String() string {
 	var s string
 	for k, v := range h {
@@ -43,7 +51,6 @@ func (h header) String() string {
 
 type fileMeta struct {
 	// Path relative to cache dir: <host>/<bucket>/<bucketPath>/<filename>
-	// TODO(bep) consider bucket per host
 	Filename string `storm:"id"`
 
 	// Size in bytes.
@@ -55,26 +62,173 @@ type fileMeta struct {
 	// HTTP status code. Note that only HTTP 200's are stored on the file system.
 	StatusCode int
 
-	// We store a sub-set of the headers received from S3 and replay when
+	// We store a sub-set of the headers received from the origin and replay when
 	// reading from cache.
 	Header header
 
 	CreatedAt time.Time `storm:"index"`
+
+	// When this was last served and how many times. These are collected in
+	// memory and written in batches, see accessLog.
+	LastAccess time.Time
+	Hits       int64
+
+	// When this needs to be revalidated with the origin. Zero means never.
+	Expires time.Time
+
+	// The URL this was fetched from.
+	OriginURL string
+
+	// Hex encoded MD5 of the cached file.
+	Checksum string
+
+	// For chunks of an object, the size of the full object.
+	ObjectSize int64
+
+	// Surrogate keys from the origin, see Config.SurrogateKeyHeader.
+	Tags []string
+
+	// Set if the object was passed on to the client only, see isStorable.
+	noStore bool
+}
+
+// clientWriter writes to a client until the first error, e.g. when the client
+// has gone away, and drops the rest, so a cache fill shared with others can
+// go on without it.
+type clientWriter struct {
+	w   io.Writer
+	err error
 }
 
+func (c *clientWriter) Write(p []byte) (int, error) {
+	if c.err == nil {
+		_, c.err = c.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// trackingResponseWriter records whether anything has been written.
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *trackingResponseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *trackingResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+// discardResponseWriter is used when filling the cache in the background.
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header {
+	return make(http.Header)
+}
+
+func (discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardResponseWriter) WriteHeader(int) {}
+
 type readSeekCloser interface {
 	io.ReadSeeker
 	io.Closer
 }
 
 type cache struct {
-	cfg     Config
-	logger  *Logger
-	storage s3Client
+	cfg    Config
+	logger *Logger
+
+	meta metaStore
+
+	// Keyed by host name.
+	hosts map[string]*hostPartition
+
+	// Keyed by host name.
+	origins map[string]Origin
+
+	// Makes sure we only fetch the same object from the origin once at a time.
+	fills *fillGroup
+
+	access *accessLog
+
+	// Optional in-memory tier for hot objects.
+	mem *memoryTier
+
+	usage cacheUsage
+
+	// Signalled, without blocking, after new objects are stored.
+	filled chan struct{}
+
+	// Sorts the entries in the order to evict them.
+	evictionOrder func(files []fileMeta)
+
+	now func() time.Time
+
+	// Stops the background goroutines.
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// Set when closing, after which no new background work is started.
+	closeMu sync.Mutex
+	closing bool
 }
 
-func newCache(cfg Config, logger *Logger) *cache {
-	return &cache{cfg: cfg, logger: logger, storage: s3Client{cfg: cfg, logger: logger}}
+func newCache(cfg Config, logger *Logger) (*cache, error) {
+	var (
+		origins   = make(map[string]Origin)
+		transport = newOriginTransport(cfg)
+	)
+
+	for name, host := range cfg.Hosts {
+		origin, err := newOrigin(cfg, host, transport, logger)
+		if err != nil {
+			return nil, err
+		}
+		origins[name] = origin
+	}
+
+	evictionOrder, err := newEvictionPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := newMetaStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts, err := newHostPartitions(cfg, meta)
+	if err != nil {
+		meta.close()
+		return nil, err
+	}
+
+	c := &cache{
+		cfg:           cfg,
+		logger:        logger,
+		meta:          meta,
+		hosts:         hosts,
+		origins:       origins,
+		fills:         newFillGroup(),
+		access:        newAccessLog(),
+		mem:           newMemoryTier(cfg),
+		evictionOrder: evictionOrder,
+		now:           time.Now,
+		filled:        make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+
+	c.wg.Add(1)
+	go c.flushAccessLoop()
+
+	return c, nil
 }
 
 func (c *cache) handleRequest(rw http.ResponseWriter, req *http.Request) error {
@@ -87,101 +241,566 @@ func (c *cache) handleRequest(rw http.ResponseWriter, req *http.Request) error {
 
 	host, found := c.cfg.host(req.Host)
 	if !found {
-		return fmt.Errorf("host %s not found", req.Host)
+		return statusError{status: http.StatusMisdirectedRequest, err: fmt.Errorf("host %s not found", req.Host)}
 	}
 
 	relPath := host.hostPath(urlPath)
 
+	now := c.now()
+
+	var memGeneration uint64
+	if c.mem != nil {
+		if e := c.mem.get(relPath); e != nil && !e.meta.isStale(now) {
+			c.access.touch(relPath, now)
+			c.serveContent(rw, req, urlPath, &e.meta, bytes.NewReader(e.body))
+			return nil
+		}
+		memGeneration = c.mem.generation(relPath)
+	}
+
 	meta, err := c.getFileMeta(relPath)
 	if err != nil {
 		return err
 	}
 
-	if meta != nil {
-		c.logger.Debug("area", "cache", "filename", meta.Filename, "status", meta.StatusCode, "header", meta.Header)
+	if meta == nil && req.Method == "HEAD" {
+		return c.proxyHead(rw, req, urlPath, host)
+	}
 
-		f, err := c.getFile(relPath)
+	if meta == nil {
+		r, hasRange := parseRange(req.Header.Get("Range"))
+
+		if c.chunkSize() > 0 {
+			chunked := hasRange
+			if !chunked {
+				if chunked, err = c.hasChunks(relPath); err != nil {
+					return err
+				}
+			}
+			if chunked {
+				w := &trackingResponseWriter{ResponseWriter: rw}
+				err := c.serveChunked(w, req, relPath, urlPath, host, r, hasRange)
+				notStorable := errors.Is(err, errNotStorable)
+				if w.wroteHeader || !notStorable && !errors.Is(err, errRangesNotSupported) {
+					return err
+				}
+
+				// Serve it as a whole instead, and drop any chunks we have of it.
+				if _, err := c.purgePrefix(relPath + chunkDirSuffix + "/"); err != nil {
+					return err
+				}
+				if notStorable && hasRange {
+					return c.proxyRange(rw, urlPath, host, r)
+				}
+			}
+		} else if hasRange {
+			return c.proxyRange(rw, urlPath, host, r)
+		}
+	}
+
+	switch {
+	case meta != nil && meta.StatusCode == http.StatusOK && meta.staleWithin(now, host.StaleWhileRevalidate.Duration):
+		// Serve the stale copy and refresh it in the background.
+		stale := meta
+		c.background(func() {
+			if _, _, err := c.fill(relPath, urlPath, host, stale, discardResponseWriter{}, req); err != nil {
+				c.logger.Error("area", "cache", "tag", "revalidate", "filename", relPath, "error", err)
+			}
+		})
+	case meta == nil || meta.isStale(now):
+		stale := meta
+
+		var written bool
+		meta, written, err = c.fill(relPath, urlPath, host, stale, rw, req)
 		if err != nil {
+			// Always prefer a stale copy over nothing when the origin is known to be down.
+			if written || stale == nil ||
+				!stale.staleWithin(now, host.StaleIfError.Duration) && !errors.Is(err, errCircuitOpen) {
+				return err
+			}
+			c.logger.Error("area", "cache", "tag", "stale-if-error", "filename", relPath, "error", err)
+			meta = stale
+		} else if written {
+			// The fill above has already written the response.
+			c.access.touch(relPath, now)
+			return nil
+		}
+	}
+
+	c.access.touch(relPath, now)
+
+	c.logger.Debug("area", "cache", "filename", meta.Filename, "status", meta.StatusCode, "header", meta.Header)
+
+	f, err := c.openVerified(meta)
+	if err != nil {
+		return err
+	}
+
+	if f == nil {
+		// The file is missing or corrupt. Start over with a fresh copy.
+		c.logger.Error("area", "cache", "tag", "heal", "filename", relPath)
+
+		if err := c.removeFile(*meta); err != nil {
+			return err
+		}
+
+		var written bool
+		meta, written, err = c.fill(relPath, urlPath, host, nil, rw, req)
+		if err != nil || written {
 			return err
 		}
 
+		f, err = c.getFile(relPath)
+		if err != nil {
+			return err
+		}
 		if f == nil {
-			// File has been deleted by some other process.
-			// TODO(bep)
-			fmt.Println("TODO")
+			return fmt.Errorf("%s: file missing after refetch", relPath)
+		}
+	}
+
+	defer f.Close()
+
+	if meta.StatusCode != http.StatusOK {
+		// A cached error, e.g. a 404. Prefer the host's error page, unless
+		// that is what we are serving.
+		if _, isErrorPage := rw.(*errorPageWriter); !isErrorPage && c.serveErrorPage(rw, req, host, meta.StatusCode) {
 			return nil
 		}
+		return c.serveStatus(rw, req, meta, f)
+	}
 
-		defer f.Close()
-		for k, v := range meta.Header {
-			for _, vv := range v {
-				rw.Header().Add(k, vv)
-			}
+	if c.mem != nil && c.mem.fits(meta.Size) {
+		body, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if int64(len(body)) == meta.Size {
+			c.mem.put(*meta, body, memGeneration)
+		}
+		c.serveContent(rw, req, urlPath, meta, bytes.NewReader(body))
+		return nil
+	}
+
+	c.serveContent(rw, req, urlPath, meta, f)
+	return nil
+}
+
+func (c *cache) serveContent(rw http.ResponseWriter, req *http.Request, urlPath string, meta *fileMeta, content io.ReadSeeker) {
+	for k, v := range meta.Header {
+		for _, vv := range v {
+			rw.Header().Add(k, vv)
+		}
+	}
+	http.ServeContent(rw, req, urlPath, meta.ModTime, content)
+}
+
+// serveStatus serves a cached response that is not a 200 with its status code.
+func (c *cache) serveStatus(rw http.ResponseWriter, req *http.Request, meta *fileMeta, content io.Reader) error {
+	for k, v := range meta.Header {
+		for _, vv := range v {
+			rw.Header().Add(k, vv)
 		}
-		http.ServeContent(rw, req, urlPath, meta.ModTime, f)
+	}
+	rw.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+
+	rw.WriteHeader(meta.StatusCode)
+
+	if req.Method == "HEAD" {
 		return nil
+	}
+
+	_, err := io.Copy(rw, content)
+
+	return err
+}
 
+// proxyHead answers a HEAD request for an object not in the cache with a
+// HEAD request to the origin, so no body is fetched that nobody asked for.
+func (c *cache) proxyHead(rw http.ResponseWriter, req *http.Request, urlPath string, host Host) error {
+	cond := make(http.Header)
+	for _, k := range []string{"If-None-Match", "If-Modified-Since"} {
+		if v := req.Header.Get(k); v != "" {
+			cond.Set(k, v)
+		}
 	}
 
-	meta, err = c.getAndWriteFile(urlPath, host, rw, req)
+	resp, err := c.origins[host.Name].Head(host.bucketPath(urlPath), cond)
 	if err != nil {
+		return upstreamError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return statusError{status: http.StatusNotFound, err: fmt.Errorf("%s: %d from origin", urlPath, resp.StatusCode)}
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		return upstreamStatusError(urlPath, resp.StatusCode)
+	}
+
+	meta := newFileMeta(host.hostPath(urlPath), resp)
+	c.setTags(meta)
+	for k, v := range meta.Header {
+		for _, vv := range v {
+			rw.Header().Add(k, vv)
+		}
+	}
+	if resp.ContentLength >= 0 && resp.StatusCode != http.StatusNotModified {
+		rw.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	rw.WriteHeader(resp.StatusCode)
+
+	return nil
+}
+
+// fill fetches the object at urlPath from the origin, or revalidates it if stale
+// is set, and stores it in the cache. Concurrent fills for the same object
+// are coalesced. written reports whether a response was written to rw.
+func (c *cache) fill(relPath, urlPath string, host Host, stale *fileMeta,
+	rw http.ResponseWriter, req *http.Request) (meta *fileMeta, written bool, err error) {
+
+	w := &trackingResponseWriter{ResponseWriter: rw}
+
+	var follow func(f *fill) (*fileMeta, error)
+	if _, background := rw.(discardResponseWriter); !background {
+		// Stream the object to the client while some other request fills it.
+		follow = func(f *fill) (*fileMeta, error) {
+			return c.followFill(f, w)
+		}
+	}
+
+	fetch := func(f *fill) (*fileMeta, error) {
+		meta, err := c.getAndWriteFile(urlPath, host, stale, w, req, f)
+		if err != nil {
+			return nil, err
+		}
+
+		if meta.noStore {
+			if stale != nil {
+				// We are not allowed to keep it anymore.
+				return meta, c.removeFile(*stale)
+			}
+			return meta, nil
+		}
+
+		if meta.StatusCode == http.StatusNotModified {
+			meta = stale.revalidated(meta)
+			return meta, c.metaFor(meta.Filename).put(meta)
+		}
+
+		return meta, c.store(meta, stale)
+	}
+
+	var shared bool
+	meta, shared, err = c.fills.do(relPath, fetch, follow)
+
+	if err == nil && shared && meta.noStore && !w.wroteHeader {
+		// The object we waited for was not stored, so get our own copy.
+		meta, err = fetch(nil)
+	}
+
+	return meta, w.wroteHeader, err
+}
+
+// store stores the metadata of a newly written file. stale is the
+// previous version of it, if any.
+func (c *cache) store(meta, stale *fileMeta) error {
+	usedSize, usedFiles := meta.Size, int64(1)
+
+	if stale != nil {
+		// A new version of the same object, keep its access history.
+		meta.LastAccess = stale.LastAccess
+		meta.Hits = stale.Hits
+		usedSize -= stale.Size
+		usedFiles = 0
+	} else {
+		meta.LastAccess = c.now()
+	}
+
+	if err := c.metaFor(meta.Filename).put(meta); err != nil {
 		return err
 	}
 
-	err = c.doWithDB(func(db *storm.DB) error {
-		return db.Save(meta)
-	})
+	if c.mem != nil {
+		c.mem.remove(meta.Filename)
+	}
+
+	c.addUsage(meta.Filename, usedSize, usedFiles)
 
-	return err
+	select {
+	case c.filled <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// followFill writes the object to w as it is written by the fill f. If f
+// finishes without writing anything, nothing is written to w.
+func (c *cache) followFill(f *fill, w http.ResponseWriter) (*fileMeta, error) {
+	s := f.waitStream()
+	if s == nil {
+		return f.wait()
+	}
+
+	if err := s.copyTo(w); err != nil {
+		// Prefer the reason the fill failed.
+		if _, ferr := f.wait(); ferr != nil {
+			return nil, ferr
+		}
+		return nil, err
+	}
+
+	return f.wait()
 }
 
 func (c *cache) getFileMeta(relPath string) (*fileMeta, error) {
-	db, err := c.openDB()
+	return c.metaFor(relPath).get(relPath)
+}
+
+// getAndWriteFile fetches the object from the host's origin and writes it
+// to both the client and the cache. If stale is set, the object is only
+// fetched if it has changed; if it has not, the returned fileMeta will
+// have status 304 and nothing is written. If fl is set, the followers of
+// that fill can stream the object while it is written.
+func (c *cache) getAndWriteFile(
+	urlPath string, host Host, stale *fileMeta,
+	rw http.ResponseWriter, req *http.Request, fl *fill) (*fileMeta, error) {
+
+	var cond http.Header
+	if stale != nil {
+		cond = stale.conditionalHeader()
+	}
+
+	resp, err := c.origins[host.Name].Get(host.bucketPath(urlPath), cond)
 	if err != nil {
-		return nil, err
+		return nil, upstreamError(err)
 	}
-	defer db.Close()
+	defer resp.Body.Close()
 
-	var fm fileMeta
+	relPath := host.hostPath(urlPath)
 
-	err = db.One("Filename", relPath, &fm)
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		if !isStorable(resp.Header) {
+			// We need the body to pass it on.
+			resp.Body.Close()
+			return c.getAndWriteFile(urlPath, host, nil, rw, req, fl)
+		}
+		meta := newFileMeta(relPath, resp)
+		meta.Expires = host.expiresAt(resp.Header, c.now())
+		c.setTags(meta)
+		return meta, nil
+	}
+
+	if !cacheableStatusCode(resp.StatusCode) {
+		return nil, upstreamStatusError(urlPath, resp.StatusCode)
+	}
+
+	if !isStorable(resp.Header) {
+		return c.passThrough(rw, urlPath, relPath, resp)
+	}
+
+	filename := c.osFilename(relPath)
+
+	f, err := createCacheFile(filename)
 	if err != nil {
-		if err == storm.ErrNotFound {
-			return nil, nil
+		return nil, err
+	}
+	defer f.abort()
+
+	meta := newFileMeta(relPath, resp)
+	c.setTags(meta)
+	if resp.StatusCode == http.StatusOK {
+		meta.Expires = host.expiresAt(resp.Header, c.now())
+	} else {
+		meta.Expires = host.negativeExpiresAt(resp.Header, c.now())
+	}
+
+	content := io.Reader(resp.Body)
+
+	if resp.StatusCode != http.StatusOK && host.isS3Origin() {
+		// Do not pass on S3's XML error documents.
+		text := http.StatusText(resp.StatusCode)
+		content = strings.NewReader(text)
+		meta.Size = int64(len(text))
+		meta.Header["Content-Type"] = []string{"text/plain; charset=utf-8"}
+	}
+
+	stream := newFillStream(f.tmp.Name(), filename, meta.StatusCode, meta.Header)
+
+	committed := false
+	defer func() {
+		if !committed {
+			stream.finish(errFillAborted)
 		}
+	}()
+
+	// Error responses are left to the caller, see handleRequest.
+	out := ioutil.Discard
+	if resp.StatusCode == http.StatusOK {
+		// Let concurrent requests for the same object follow along.
+		if fl != nil {
+			fl.setStream(stream)
+		}
+
+		for k, v := range meta.Header {
+			for _, vv := range v {
+				rw.Header().Add(k, vv)
+			}
+		}
+
+		rw.WriteHeader(resp.StatusCode)
+
+		// Only the origin or the disk failing should abort the fill.
+		out = &clientWriter{w: rw}
+	}
+
+	// Stream to both file and clients at the same time.
+	if _, err := io.Copy(io.MultiWriter(f, stream, out), content); err != nil {
 		return nil, err
 	}
 
-	return &fm, nil
+	if meta.Size >= 0 && f.n != meta.Size {
+		return nil, fmt.Errorf("incomplete download of %s: got %d of %d bytes", meta.Filename, f.n, meta.Size)
+	}
+	meta.Size = f.n
+	meta.Checksum = f.checksum()
+
+	if resp.StatusCode == http.StatusOK {
+		if expected := originMD5(host, resp.Header); expected != "" && expected != meta.Checksum {
+			return nil, fmt.Errorf("corrupt download of %s: got MD5 %s, expected %s", meta.Filename, meta.Checksum, expected)
+		}
+	}
+
+	if err := f.commit(); err != nil {
+		return nil, err
+	}
+
+	committed = true
+	stream.finish(nil)
+
+	return meta, nil
 }
 
-func (c *cache) getAndWriteFile(
-	urlPath string, host Host,
-	rw http.ResponseWriter, req *http.Request) (*fileMeta, error) {
+// passThrough writes a response we are not allowed to store to the client
+// and returns its metadata with noStore set.
+func (c *cache) passThrough(rw http.ResponseWriter, urlPath, relPath string, resp *http.Response) (*fileMeta, error) {
+	if resp.StatusCode != http.StatusOK {
+		// Left to the caller, like any other error.
+		return nil, statusError{status: resp.StatusCode, err: fmt.Errorf("%s: %d from origin", urlPath, resp.StatusCode)}
+	}
 
-	// TODO(bep) temp file and rename
-	filename := filepath.Join(c.cfg.CacheDir, host.hostPath(urlPath))
-	dir := filepath.Dir(filename)
+	meta := newFileMeta(relPath, resp)
+	meta.noStore = true
+	c.setTags(meta)
 
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, err
+	for k, v := range meta.Header {
+		for _, vv := range v {
+			rw.Header().Add(k, vv)
+		}
 	}
+	if resp.ContentLength >= 0 {
+		rw.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	rw.WriteHeader(resp.StatusCode)
+
+	_, err := io.Copy(rw, resp.Body)
+
+	return meta, err
+}
+
+// cacheFile is a cache file being written. It is written to a temporary
+// file in the same directory and renamed when we know we have it all, so
+// we never serve a partial file.
+type cacheFile struct {
+	filename string
+	tmp      *os.File
+	hash     hash.Hash
+	n        int64
+	done     bool
+}
 
-	f, err := os.Create(filename)
+func createCacheFile(filename string) (*cacheFile, error) {
+	f, err := createTempFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	return &cacheFile{filename: filename, tmp: f, hash: md5.New()}, nil
+}
+
+func (f *cacheFile) Write(p []byte) (int, error) {
+	n, err := f.tmp.Write(p)
+	f.hash.Write(p[:n])
+	f.n += int64(n)
+	return n, err
+}
+
+// checksum returns the MD5 of what has been written so far.
+func (f *cacheFile) checksum() string {
+	return hex.EncodeToString(f.hash.Sum(nil))
+}
+
+// commit syncs the file to disk and moves it in place.
+func (f *cacheFile) commit() error {
+	if err := f.tmp.Sync(); err != nil {
+		return err
+	}
+	if err := f.tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.tmp.Name(), f.filename); err != nil {
+		return err
+	}
+	f.done = true
+	return nil
+}
+
+// abort removes the temporary file unless committed.
+func (f *cacheFile) abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+}
 
-	// Stream to both file and client at the same time.
-	mw := io.MultiWriter(rw, f)
+// createTempFile creates a temporary file next to filename, and the
+// directory for it if needed. See tempFileTarget.
+func createTempFile(filename string) (*os.File, error) {
+	dir := filepath.Dir(filename)
+
+	for retried := false; ; retried = true {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+
+		f, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+		if err != nil && !retried && os.IsNotExist(err) {
+			// Removed as empty by the reconciler in the meantime.
+			continue
+		}
 
-	return c.storage.getAndWrite(urlPath, host, mw, rw, req)
+		return f, err
+	}
+}
 
+// tempFileTarget returns the file the temporary file was created for,
+// or false if it is not one of ours.
+func tempFileTarget(filename string) (string, bool) {
+	name := filepath.Base(filename)
+	i := strings.LastIndex(name, ".tmp")
+	if !strings.HasPrefix(name, ".") || i < 2 {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(filename), name[1:i]), true
 }
 
 func (c *cache) getFile(relPath string) (readSeekCloser, error) {
-	filename := filepath.Join(c.cfg.CacheDir, filepath.FromSlash(relPath))
+	filename := c.osFilename(relPath)
 	f, err := os.Open(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -192,16 +811,34 @@ func (c *cache) getFile(relPath string) (readSeekCloser, error) {
 	return f, nil
 }
 
-// TODO(bep) transactions
-func (c *cache) doWithDB(f func(db *storm.DB) error) error {
-	db, err := c.openDB()
-	if err != nil {
-		return err
+// background runs fn in its own goroutine, which close waits for, unless
+// the cache is closing.
+func (c *cache) background(fn func()) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closing {
+		return
 	}
-	defer db.Close()
-	return f(db)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		fn()
+	}()
 }
 
-func (c *cache) openDB() (*storm.DB, error) {
-	return storm.Open(c.cfg.DBFilename, storm.BoltOptions(0600, &bolt.Options{Timeout: 10 * time.Second}))
+func (c *cache) close() error {
+	c.closeMu.Lock()
+	c.closing = true
+	c.closeMu.Unlock()
+
+	close(c.done)
+	c.wg.Wait()
+
+	if err := c.flushAccess(); err != nil {
+		c.logger.Error("area", "cache", "tag", "access", "error", err)
+	}
+
+	return c.meta.close()
 }
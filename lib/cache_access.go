@@ -0,0 +1,101 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// How often the collected cache hits are written to the metadata store.
+const accessFlushInterval = 30 * time.Second
+
+type accessEntry struct {
+	last time.Time
+	hits int64
+}
+
+// accessLog collects cache hits in memory so we don't have to write to
+// the metadata store on every request.
+type accessLog struct {
+	mu      sync.Mutex
+	entries map[string]accessEntry
+}
+
+func newAccessLog() *accessLog {
+	return &accessLog{entries: make(map[string]accessEntry)}
+}
+
+func (a *accessLog) touch(filename string, t time.Time) {
+	a.mu.Lock()
+	e := a.entries[filename]
+	if t.After(e.last) {
+		e.last = t
+	}
+	e.hits++
+	a.entries[filename] = e
+	a.mu.Unlock()
+}
+
+// drain returns the collected entries and starts over.
+func (a *accessLog) drain() map[string]accessEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries := a.entries
+	a.entries = make(map[string]accessEntry)
+
+	return entries
+}
+
+// flushAccess writes the collected cache hits to the metadata store. Only
+// the access fields are touched, so we do not undo a fill that has stored
+// a new version of the object in the meantime.
+func (c *cache) flushAccess() error {
+	var lastErr error
+
+	for filename, e := range c.access.drain() {
+		// Records purged or evicted since are left alone.
+		err := c.metaFor(filename).update(filename, func(m *fileMeta) {
+			if e.last.After(m.LastAccess) {
+				m.LastAccess = e.last
+			}
+			m.Hits += e.hits
+		})
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+func (c *cache) flushAccessLoop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(accessFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.flushAccess(); err != nil {
+				c.logger.Error("area", "cache", "tag", "access", "error", err)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
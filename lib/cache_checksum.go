@@ -0,0 +1,83 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// originMD5 returns the MD5 of the object as reported by S3 in the ETag,
+// or an empty string if it is not known. The ETag is not the MD5 for
+// multipart uploads and objects encrypted with SSE-KMS or SSE-C.
+func originMD5(host Host, h http.Header) string {
+	if !host.isS3Origin() {
+		return ""
+	}
+
+	if sse := h.Get("X-Amz-Server-Side-Encryption"); sse != "" && sse != "AES256" {
+		return ""
+	}
+
+	if h.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return ""
+	}
+
+	etag := strings.ToLower(strings.Trim(h.Get("Etag"), `"`))
+	if len(etag) != md5.Size*2 {
+		return ""
+	}
+	if _, err := hex.DecodeString(etag); err != nil {
+		return ""
+	}
+
+	return etag
+}
+
+// openVerified opens the cached file. It returns nil if the file is
+// missing or, if VerifyChecksums is enabled, does not match its checksum.
+func (c *cache) openVerified(meta *fileMeta) (readSeekCloser, error) {
+	f, err := c.getFile(meta.Filename)
+	if err != nil || f == nil {
+		return f, err
+	}
+
+	if !c.cfg.VerifyChecksums || meta.Checksum == "" {
+		return f, nil
+	}
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != meta.Checksum {
+		f.Close()
+		c.logger.Error("area", "cache", "tag", "checksum", "filename", meta.Filename,
+			"expected", meta.Checksum, "got", checksum)
+		return nil, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,133 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginMD5(t *testing.T) {
+	assert := require.New(t)
+
+	const sum = "d41d8cd98f00b204e9800998ecf8427e"
+
+	for _, test := range []struct {
+		origin string
+		header http.Header
+		expect string
+	}{
+		{"", http.Header{"Etag": {`"` + sum + `"`}}, sum},
+		{"s3", http.Header{"Etag": {`"D41D8CD98F00B204E9800998ECF8427E"`}}, sum},
+		{"", http.Header{"Etag": {`"` + sum + `"`}, "X-Amz-Server-Side-Encryption": {"AES256"}}, sum},
+		// Multipart upload.
+		{"", http.Header{"Etag": {`"` + sum + `-2"`}}, ""},
+		{"", http.Header{"Etag": {`"` + sum + `"`}, "X-Amz-Server-Side-Encryption": {"aws:kms"}}, ""},
+		{"", http.Header{"Etag": {`"` + sum + `"`}, "X-Amz-Server-Side-Encryption-Customer-Algorithm": {"AES256"}}, ""},
+		{"", http.Header{"Etag": {`"not-hex-not-hex-not-hex-not-hex!"`}}, ""},
+		{"http", http.Header{"Etag": {`"` + sum + `"`}}, ""},
+		{"", http.Header{}, ""},
+	} {
+		assert.Equal(test.expect, originMD5(Host{Origin: test.origin}, test.header), test.header.Get("Etag"))
+	}
+}
+
+func TestCacheHealMissingFile(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{objects: map[string]string{"/index.html": "v1"}}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil)))
+		assert.Equal(http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	assert.Equal("v1", get())
+
+	filename := c.osFilename("example.org/bucket1/index.html")
+	assert.NoError(os.Remove(filename))
+
+	assert.Equal("v1", get())
+	assert.Equal(int32(2), s3.requests)
+	_, err := os.Stat(filename)
+	assert.NoError(err)
+
+	assert.Equal("v1", get())
+	assert.Equal(int32(2), s3.requests)
+}
+
+func TestCacheVerifyChecksums(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{objects: map[string]string{"/index.html": "v1"}}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil)))
+		assert.Equal(http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	assert.Equal("v1", get())
+
+	meta, err := c.getFileMeta("example.org/bucket1/index.html")
+	assert.NoError(err)
+	assert.Equal("6654c734ccab8f440ff0825eb443dc7f", meta.Checksum)
+
+	// Flip a bit on disk.
+	assert.NoError(ioutil.WriteFile(c.osFilename(meta.Filename), []byte("v0"), 0644))
+
+	assert.Equal("v0", get())
+
+	c.cfg.VerifyChecksums = true
+
+	assert.Equal("v1", get())
+	assert.Equal("v1", get())
+	assert.Equal(int32(2), s3.requests)
+}
+
+func TestCacheRejectsCorruptDownload(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects: map[string]string{"/index.html": "v1"},
+		etag:    `"d41d8cd98f00b204e9800998ecf8427e"`,
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	rec := httptest.NewRecorder()
+	err := c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil))
+	assert.Error(err)
+	assert.Contains(err.Error(), "corrupt download")
+
+	meta, err := c.getFileMeta("example.org/bucket1/index.html")
+	assert.NoError(err)
+	assert.Nil(meta)
+}
@@ -0,0 +1,301 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// The chunks of an object are stored as <relPath>.s3p-chunks/<index>.
+const chunkDirSuffix = ".s3p-chunks"
+
+var (
+	errObjectChanged = errors.New("object changed while reading it in chunks")
+
+	// The origin does not allow the object to be cached, see isStorable.
+	errNotStorable = errors.New("object may not be stored")
+
+	// The origin ignored our Range header and sent the full object.
+	errRangesNotSupported = errors.New("origin does not support range requests")
+)
+
+type rangeNotSatisfiableError struct {
+	size int64
+}
+
+func (e rangeNotSatisfiableError) Error() string {
+	return fmt.Sprintf("range not satisfiable, size is %d", e.size)
+}
+
+func chunkPath(relPath string, index int64) string {
+	return fmt.Sprintf("%s%s/%010d", relPath, chunkDirSuffix, index)
+}
+
+func (c *cache) chunkSize() int64 {
+	return int64(c.cfg.ChunkSize)
+}
+
+// hasChunks reports whether any part of the object is cached in chunks.
+// It may not be the first, as range requests start anywhere.
+func (c *cache) hasChunks(relPath string) (bool, error) {
+	prefix := relPath + chunkDirSuffix + "/"
+	files, err := c.metaFor(prefix).withPrefix(prefix)
+	return len(files) > 0, err
+}
+
+// serveChunked serves the object, or the given range of it, from its
+// cached chunks, fetching the missing ones from the origin.
+func (c *cache) serveChunked(rw http.ResponseWriter, req *http.Request, relPath, urlPath string, host Host, r rangeSpec, hasRange bool) error {
+	cs := c.chunkSize()
+
+	// We need one chunk to know the size of the object. Start with the first
+	// one we need, if we know it.
+	var firstIndex int64
+	if hasRange && r.first > 0 {
+		firstIndex = r.first / cs
+	}
+
+	first, f, err := c.getChunk(relPath, urlPath, host, firstIndex, "")
+	if err != nil {
+		var rerr rangeNotSatisfiableError
+		if errors.As(err, &rerr) {
+			return writeRangeNotSatisfiable(rw, rerr.size)
+		}
+		return err
+	}
+	defer f.Close()
+
+	size := first.ObjectSize
+	start, end := int64(0), size-1
+
+	if hasRange {
+		var ok bool
+		if start, end, ok = r.resolve(size); !ok {
+			return writeRangeNotSatisfiable(rw, size)
+		}
+	}
+
+	for k, v := range first.Header {
+		for _, vv := range v {
+			rw.Header().Add(k, vv)
+		}
+	}
+	rw.Header().Set("Accept-Ranges", "bytes")
+	rw.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+
+	if hasRange {
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		rw.WriteHeader(http.StatusPartialContent)
+	} else {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if req.Method == "HEAD" {
+		return nil
+	}
+
+	etag := first.Header.get("Etag")
+
+	for index := start / cs; size > 0 && index <= end/cs; index++ {
+		meta, cf := first, f
+		if index != firstIndex {
+			meta, cf, err = c.getChunk(relPath, urlPath, host, index, etag)
+			if err != nil {
+				if errors.Is(err, errObjectChanged) || errors.Is(err, errNotStorable) {
+					// Start over with the new version on the next request.
+					if _, perr := c.purgePrefix(relPath + chunkDirSuffix + "/"); perr != nil {
+						c.logger.Error("area", "cache", "tag", "chunk", "filename", relPath, "error", perr)
+					}
+				}
+				return err
+			}
+		}
+
+		if err := copyChunk(rw, cf, index*cs, meta.Size, start, end); err != nil {
+			if cf != f {
+				cf.Close()
+			}
+			return err
+		}
+
+		if cf != f {
+			cf.Close()
+		}
+	}
+
+	return nil
+}
+
+// copyChunk copies the part of the chunk at offset within start and end to w.
+func copyChunk(w io.Writer, chunk io.ReadSeeker, offset, size, start, end int64) error {
+	from, to := start, end
+	if from < offset {
+		from = offset
+	}
+	if last := offset + size - 1; to > last {
+		to = last
+	}
+
+	if _, err := chunk.Seek(from-offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(w, chunk, to-from+1)
+
+	return err
+}
+
+func writeRangeNotSatisfiable(rw http.ResponseWriter, size int64) error {
+	rw.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	rw.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	return nil
+}
+
+// getChunk opens a chunk of the object, fetching it from the origin if it
+// is not in the cache or is stale. If etag is set, the chunk must belong to
+// that version of the object.
+func (c *cache) getChunk(relPath, urlPath string, host Host, index int64, etag string) (*fileMeta, readSeekCloser, error) {
+	var (
+		filename = chunkPath(relPath, index)
+		now      = c.now()
+	)
+
+	meta, err := c.getFileMeta(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if meta != nil && !meta.isStale(now) && (etag == "" || meta.Header.get("Etag") == etag) {
+		f, err := c.openVerified(meta)
+		if err != nil {
+			return nil, nil, err
+		}
+		if f != nil {
+			c.access.touch(filename, now)
+			return meta, f, nil
+		}
+	}
+
+	stale := meta
+
+	meta, _, err = c.fills.do(filename, func(*fill) (*fileMeta, error) {
+		return c.fetchChunk(relPath, urlPath, host, index, etag, stale)
+	}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := c.getFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f == nil {
+		return nil, nil, fmt.Errorf("%s: chunk missing after fetch", filename)
+	}
+
+	c.access.touch(filename, now)
+
+	return meta, f, nil
+}
+
+// fetchChunk fetches a chunk from the origin with a range request and
+// stores it in the cache.
+func (c *cache) fetchChunk(relPath, urlPath string, host Host, index int64, etag string, stale *fileMeta) (*fileMeta, error) {
+	cs := c.chunkSize()
+	r := rangeSpec{first: index * cs, last: (index+1)*cs - 1}
+
+	h := http.Header{"Range": {r.String()}}
+	if etag != "" {
+		h.Set("If-Match", etag)
+	}
+
+	resp, err := c.origins[host.Name].Get(host.bucketPath(urlPath), h)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, errRangesNotSupported
+	case http.StatusRequestedRangeNotSatisfiable:
+		var size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size); err != nil {
+			return nil, fmt.Errorf("range %s of %s not satisfiable", r, urlPath)
+		}
+		return nil, rangeNotSatisfiableError{size: size}
+	case http.StatusPreconditionFailed:
+		return nil, errObjectChanged
+	case http.StatusNotFound:
+		return nil, statusError{status: http.StatusNotFound, err: fmt.Errorf("%s: %d from origin", urlPath, resp.StatusCode)}
+	default:
+		return nil, upstreamStatusError(urlPath, resp.StatusCode)
+	}
+
+	if !isStorable(resp.Header) {
+		return nil, errNotStorable
+	}
+
+	start, end, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+	if start != r.first {
+		return nil, fmt.Errorf("Failed for path %s: asked for range %s, got %d-%d", urlPath, r, start, end)
+	}
+
+	filename := chunkPath(relPath, index)
+
+	meta := newFileMeta(filename, resp)
+	c.setTags(meta)
+	delete(meta.Header, "Content-Range")
+	meta.StatusCode = http.StatusOK
+	meta.ObjectSize = size
+	meta.Expires = host.expiresAt(resp.Header, c.now())
+
+	meta.Size, meta.Checksum, err = c.writeCacheFile(filename, resp.Body, end-start+1)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, c.store(meta, stale)
+}
+
+// writeCacheFile writes the expected number of bytes from r to the cache
+// file for relPath and returns the number of bytes written and their MD5.
+func (c *cache) writeCacheFile(relPath string, r io.Reader, expected int64) (int64, string, error) {
+	f, err := createCacheFile(c.osFilename(relPath))
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.abort()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return 0, "", err
+	}
+	if f.n != expected {
+		return 0, "", fmt.Errorf("incomplete download of %s: got %d of %d bytes", relPath, f.n, expected)
+	}
+
+	if err := f.commit(); err != nil {
+		return 0, "", err
+	}
+
+	return f.n, f.checksum(), nil
+}
@@ -0,0 +1,140 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// statusError is an error with the HTTP status code to respond with.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e statusError) Unwrap() error {
+	return e.err
+}
+
+// upstreamError wraps an error talking to the origin.
+func upstreamError(err error) error {
+	status := http.StatusBadGateway
+
+	var nerr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &nerr) && nerr.Timeout() {
+		status = http.StatusGatewayTimeout
+	}
+
+	return statusError{status: status, err: err}
+}
+
+// upstreamStatusError is returned when the origin answers with a status we
+// cannot pass on, e.g. a 403 because of bad credentials.
+func upstreamStatusError(urlPath string, status int) error {
+	return statusError{
+		status: http.StatusBadGateway,
+		err:    fmt.Errorf("Failed for path %s: %d", urlPath, status),
+	}
+}
+
+// errorStatus returns the status code to respond with for err.
+func errorStatus(err error) int {
+	var serr statusError
+	if errors.As(err, &serr) {
+		return serr.status
+	}
+	return http.StatusInternalServerError
+}
+
+// serveErrorPage serves the host's error page for status, if it has one,
+// and reports whether it did. The page is fetched and cached like any
+// other object.
+func (c *cache) serveErrorPage(rw http.ResponseWriter, req *http.Request, host Host, status int) bool {
+	page := host.errorPage(status)
+	if page == "" {
+		return false
+	}
+
+	// A fresh request, so conditional and range headers do not apply.
+	pageReq, err := http.NewRequest(req.Method, "/"+strings.TrimLeft(page, "/"), nil)
+	if err != nil {
+		return false
+	}
+	pageReq.Host = req.Host
+
+	w := &errorPageWriter{ResponseWriter: rw, header: make(http.Header), status: status}
+
+	if err := c.handleRequest(w, pageReq); err != nil || !w.ok {
+		c.logger.Error("area", "cache", "tag", "error-page", "page", page, "error", err)
+	}
+
+	// If it failed halfway, there is nothing more we can do.
+	return w.ok
+}
+
+// errorPageWriter writes a successful response with the given status
+// instead, and discards anything else.
+type errorPageWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	status      int
+	wroteHeader bool
+	ok          bool
+}
+
+func (w *errorPageWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *errorPageWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.ok = status == http.StatusOK
+	if !w.ok {
+		return
+	}
+
+	for k, v := range w.header {
+		switch k {
+		case "Etag", "Last-Modified", "Cache-Control", "Expires", "Accept-Ranges":
+			// These describe the error page, not the missing object.
+			continue
+		}
+		w.ResponseWriter.Header()[k] = v
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *errorPageWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.ok {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
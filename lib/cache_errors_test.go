@@ -0,0 +1,92 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorStatus(t *testing.T) {
+	assert := require.New(t)
+
+	timeout := &url.Error{Op: "Get", URL: "http://example.org", Err: context.DeadlineExceeded}
+
+	assert.Equal(http.StatusGatewayTimeout, errorStatus(upstreamError(timeout)))
+	assert.Equal(http.StatusBadGateway, errorStatus(upstreamError(errors.New("connection refused"))))
+	assert.Equal(http.StatusBadGateway, errorStatus(upstreamStatusError("a.html", http.StatusForbidden)))
+	assert.Equal(http.StatusNotFound, errorStatus(fmt.Errorf("wrapped: %w", statusError{status: http.StatusNotFound, err: errors.New("missing")})))
+	assert.Equal(http.StatusInternalServerError, errorStatus(errors.New("disk full")))
+
+	assert.True(errors.Is(upstreamError(errCircuitOpen), errCircuitOpen))
+}
+
+func TestServeFileErrors(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{objects: map[string]string{"/404.html": "<h1>Not Found</h1>"}}
+
+	c, clean := newTestCacheWithConfig(t, s3, func(cfg *Config) {
+		host := cfg.Hosts["example.org"]
+		host.ErrorPages = map[string]string{"404": "404.html", "502": "missing.html"}
+		cfg.Hosts["example.org"] = host
+		cfg.Hosts["example.com"] = Host{Name: "example.com", Bucket: "bucket2", AccessKey: "ak", SecretKey: "sk"}
+	})
+	defer clean()
+
+	h := (&httpHandlers{c: c}).serveFile()
+
+	get := func(method, u string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(method, u, nil))
+		return rec
+	}
+
+	rec := get("GET", "http://example.net/")
+	assert.Equal(http.StatusMisdirectedRequest, rec.Code)
+
+	// Custom error page.
+	for i := 0; i < 2; i++ {
+		rec = get("GET", "http://example.org/missing.html")
+		assert.Equal(http.StatusNotFound, rec.Code)
+		assert.Equal("<h1>Not Found</h1>", rec.Body.String())
+		assert.Equal("text/html", rec.Header().Get("Content-Type"))
+		assert.Empty(rec.Header().Get("Etag"))
+	}
+	// Both the missing object and the error page are cached.
+	assert.Equal(int32(2), s3.requests)
+
+	rec = get("HEAD", "http://example.org/missing.html")
+	assert.Equal(http.StatusNotFound, rec.Code)
+
+	// No error page.
+	rec = get("GET", "http://example.com/missing.html")
+	assert.Equal(http.StatusNotFound, rec.Code)
+	assert.Equal("Not Found", rec.Body.String())
+	assert.Equal("text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	// The error page for 502 is missing, so it falls back to the plain one.
+	s3.failStatus = http.StatusForbidden
+	rec = get("GET", "http://example.org/other.html")
+	assert.Equal(http.StatusBadGateway, rec.Code)
+	assert.Equal("Bad Gateway\n", rec.Body.String())
+}
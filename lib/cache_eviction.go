@@ -0,0 +1,69 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	evictionLRU = "lru"
+	evictionLFU = "lfu"
+)
+
+// evictionPolicies sort the cache entries so the ones to evict first
+// come first.
+var evictionPolicies = map[string]func(files []fileMeta){
+	// Least recently used.
+	evictionLRU: func(files []fileMeta) {
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].LastAccess.Before(files[j].LastAccess)
+		})
+	},
+
+	// Size-aware least frequently used: the fewest hits per byte first, so
+	// big and rarely used objects go before small and popular ones.
+	// Ties go to the least recently used.
+	evictionLFU: func(files []fileMeta) {
+		sort.SliceStable(files, func(i, j int) bool {
+			a, b := files[i].hitsPerByte(), files[j].hitsPerByte()
+			if a != b {
+				return a < b
+			}
+			return files[i].LastAccess.Before(files[j].LastAccess)
+		})
+	},
+}
+
+func newEvictionPolicy(cfg Config) (func(files []fileMeta), error) {
+	name := strings.ToLower(cfg.EvictionPolicy)
+	if name == "" {
+		name = evictionLRU
+	}
+
+	policy, found := evictionPolicies[name]
+	if !found {
+		return nil, fmt.Errorf("unknown evictionPolicy %q", cfg.EvictionPolicy)
+	}
+
+	return policy, nil
+}
+
+func (m fileMeta) hitsPerByte() float64 {
+	// Count the fill as a hit and avoid dividing by zero for empty files.
+	return float64(m.Hits+1) / float64(m.Size+1)
+}
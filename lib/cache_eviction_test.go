@@ -0,0 +1,122 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheEviction(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects: map[string]string{
+			"/a.html":   strings.Repeat("a", 10),
+			"/b.html":   strings.Repeat("b", 10),
+			"/c.html":   strings.Repeat("c", 10),
+			"/big.html": strings.Repeat("x", 100),
+		},
+	}
+
+	for _, test := range []struct {
+		policy   string
+		requests []string
+		target   int64
+		expect   []string
+	}{
+		// a is cached first, but was used last.
+		{evictionLRU, []string{"a", "b", "c", "a"}, 20, []string{"a", "c"}},
+		{evictionLRU, []string{"a", "b", "c", "a", "b"}, 10, []string{"b"}},
+		// big is the most recently used, but has the fewest hits per byte.
+		{evictionLFU, []string{"a", "b", "big", "big", "big"}, 30, []string{"a", "b"}},
+		// Ties go to the least recently used.
+		{evictionLFU, []string{"a", "b", "c", "a", "b", "c", "b"}, 20, []string{"b", "c"}},
+	} {
+		c, clean := newTestCache(t, s3)
+
+		c.evictionOrder = evictionPolicies[test.policy]
+
+		now := time.Now()
+		c.now = func() time.Time { return now }
+
+		for _, name := range test.requests {
+			now = now.Add(time.Minute)
+			rec := httptest.NewRecorder()
+			assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/"+name+".html", nil)))
+			assert.Equal(http.StatusOK, rec.Code)
+		}
+
+		_, err := c.shrinkTo(cacheLimits{size: test.target})
+		assert.NoError(err)
+
+		var cached []string
+		assert.NoError(c.meta.walk(func(m fileMeta) bool {
+			cached = append(cached, strings.TrimSuffix(strings.TrimPrefix(m.Filename, "example.org/bucket1/"), ".html"))
+			return true
+		}))
+
+		assert.ElementsMatch(test.expect, cached, test.policy+": "+strings.Join(test.requests, ","))
+
+		clean()
+	}
+}
+
+func TestCacheAccessIsBatched(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{objects: map[string]string{"/index.html": "v1"}}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	start := time.Now()
+	now := start
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Minute)
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil)))
+	}
+
+	meta, err := c.getFileMeta("example.org/bucket1/index.html")
+	assert.NoError(err)
+	assert.Equal(int64(0), meta.Hits)
+	assert.Equal(start.Add(time.Minute).Unix(), meta.LastAccess.Unix())
+
+	assert.NoError(c.flushAccess())
+
+	meta, err = c.getFileMeta("example.org/bucket1/index.html")
+	assert.NoError(err)
+	assert.Equal(int64(3), meta.Hits)
+	assert.Equal(now.Unix(), meta.LastAccess.Unix())
+}
+
+func TestNewEvictionPolicy(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := newEvictionPolicy(Config{})
+	assert.NoError(err)
+	_, err = newEvictionPolicy(Config{EvictionPolicy: "LFU"})
+	assert.NoError(err)
+	_, err = newEvictionPolicy(Config{EvictionPolicy: "fifo"})
+	assert.Error(err)
+}
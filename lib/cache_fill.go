@@ -0,0 +1,269 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var errFillAborted = errors.New("cache fill aborted")
+
+// fillGroup coalesces concurrent cache fills for the same object, so
+// only one request goes to the origin while the others wait for it to finish
+// or follow it, see fillStream.
+type fillGroup struct {
+	mu    sync.Mutex
+	fills map[string]*fill
+}
+
+type fill struct {
+	wg   sync.WaitGroup
+	meta *fileMeta
+	err  error
+
+	// The number of requests currently waiting for or following this fill.
+	// Guarded by fillGroup.mu.
+	waiters int
+
+	// Closed when the stream is set or the fill is done.
+	streamReady chan struct{}
+	streamOnce  sync.Once
+	stream      *fillStream
+}
+
+func newFillGroup() *fillGroup {
+	return &fillGroup{fills: make(map[string]*fill)}
+}
+
+// do runs fn for the given key unless a fill for the same key is already
+// in progress, in which case it calls follow, or, if follow is nil, waits
+// for that fill and returns its result.
+// shared is true if the result came from some other goroutine's fill.
+func (g *fillGroup) do(key string, fn, follow func(f *fill) (*fileMeta, error)) (meta *fileMeta, shared bool, err error) {
+	g.mu.Lock()
+	if f, found := g.fills[key]; found {
+		f.waiters++
+		g.mu.Unlock()
+
+		defer func() {
+			g.mu.Lock()
+			f.waiters--
+			g.mu.Unlock()
+		}()
+
+		if follow != nil {
+			meta, err = follow(f)
+		} else {
+			meta, err = f.wait()
+		}
+		return meta, true, err
+	}
+
+	// Make sure any waiters get an error if fn panics.
+	f := &fill{err: errFillAborted, streamReady: make(chan struct{})}
+	f.wg.Add(1)
+	g.fills[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.fills, key)
+		g.mu.Unlock()
+		f.setStream(nil)
+		f.wg.Done()
+	}()
+
+	f.meta, f.err = fn(f)
+
+	return f.meta, false, f.err
+}
+
+// waiting returns the number of requests waiting for or following the fill
+// in progress for key.
+func (g *fillGroup) waiting(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, found := g.fills[key]; found {
+		return f.waiters
+	}
+	return 0
+}
+
+// keys returns the keys of the fills in progress.
+func (g *fillGroup) keys() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	keys := make([]string, 0, len(g.fills))
+	for key := range g.fills {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// wait waits for the fill to finish.
+func (f *fill) wait() (*fileMeta, error) {
+	f.wg.Wait()
+	return f.meta, f.err
+}
+
+// setStream makes the object available to the followers while it is
+// being written. Only the first call has any effect.
+func (f *fill) setStream(s *fillStream) {
+	f.streamOnce.Do(func() {
+		f.stream = s
+		close(f.streamReady)
+	})
+}
+
+// waitStream waits for the fill to start writing the object and returns
+// its stream, or nil if it finished without one, e.g. on errors.
+func (f *fill) waitStream() *fillStream {
+	<-f.streamReady
+	return f.stream
+}
+
+// fillStream lets concurrent readers tail an object while it is written
+// to a temporary file in the cache.
+type fillStream struct {
+	// The temporary file and where it ends up when done.
+	tmpFilename string
+	filename    string
+
+	status int
+	header header
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written int64
+	done    bool
+	err     error
+}
+
+func newFillStream(tmpFilename, filename string, status int, h header) *fillStream {
+	s := &fillStream{tmpFilename: tmpFilename, filename: filename, status: status, header: h}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Write is called after p has been written to the temporary file.
+func (s *fillStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	s.written += int64(len(p))
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+// finish marks the stream as done. A nil error means the object is complete
+// and in its final location.
+func (s *fillStream) finish(err error) {
+	s.mu.Lock()
+	s.done = true
+	s.err = err
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// wait waits until there is more than off bytes written or the stream is done.
+func (s *fillStream) wait(off int64) (written int64, done bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for off >= s.written && !s.done {
+		s.cond.Wait()
+	}
+
+	return s.written, s.done, s.err
+}
+
+func (s *fillStream) waitDone() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.done {
+		s.cond.Wait()
+	}
+
+	return s.err
+}
+
+// open opens the file being written, or the final file if it is already done.
+func (s *fillStream) open() (*os.File, error) {
+	f, err := os.Open(s.tmpFilename)
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+
+	// Renamed or removed.
+	if err := s.waitDone(); err != nil {
+		return nil, err
+	}
+
+	return os.Open(s.filename)
+}
+
+// copyTo writes the response to w as the object is written to the cache.
+func (s *fillStream) copyTo(w http.ResponseWriter) error {
+	f, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for k, v := range s.header {
+		for _, vv := range v {
+			w.Header().Add(k, vv)
+		}
+	}
+	w.WriteHeader(s.status)
+
+	var (
+		buf = make([]byte, 32<<10)
+		off int64
+	)
+
+	for {
+		written, done, err := s.wait(off)
+		if err != nil {
+			return err
+		}
+
+		for off < written {
+			n := int64(len(buf))
+			if rest := written - off; rest < n {
+				n = rest
+			}
+			n2, err := f.ReadAt(buf[:n], off)
+			if n2 > 0 {
+				if _, werr := w.Write(buf[:n2]); werr != nil {
+					return werr
+				}
+				off += int64(n2)
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
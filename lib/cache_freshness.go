@@ -0,0 +1,171 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expiresAt calculates when an object fetched from the origin at the given time
+// becomes stale, based on its Cache-Control and Expires headers and the
+// host's TTL settings. The zero time means that it never expires.
+func (h Host) expiresAt(respHeader http.Header, now time.Time) time.Time {
+	ttl, found := freshnessLifetime(respHeader, now)
+	if !found {
+		ttl = h.DefaultTTL.Duration
+		if ttl <= 0 {
+			ttl = h.MaxTTL.Duration
+		}
+		if ttl <= 0 {
+			// Keep it until purged.
+			return time.Time{}
+		}
+	}
+
+	if h.MaxTTL.Duration > 0 && ttl > h.MaxTTL.Duration {
+		ttl = h.MaxTTL.Duration
+	}
+
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return now.Add(ttl)
+}
+
+const defaultNegativeTTL = time.Minute
+
+// negativeExpiresAt is expiresAt for an error response, e.g. a 404.
+func (h Host) negativeExpiresAt(respHeader http.Header, now time.Time) time.Time {
+	ttl := h.NegativeTTL.Duration
+	if ttl <= 0 {
+		ttl = defaultNegativeTTL
+	}
+
+	if lifetime, found := freshnessLifetime(respHeader, now); found && lifetime < ttl {
+		ttl = lifetime
+	}
+
+	return now.Add(ttl)
+}
+
+// freshnessLifetime returns the freshness lifetime set by the origin, if any.
+// An object that must be revalidated on every request gets a zero lifetime.
+func freshnessLifetime(respHeader http.Header, now time.Time) (time.Duration, bool) {
+	var (
+		maxAge  = -1
+		sMaxAge = -1
+	)
+
+	for _, directive := range strings.Split(respHeader.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		name, value := directive, ""
+		if i := strings.Index(directive, "="); i != -1 {
+			name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+		}
+
+		switch name {
+		case "no-cache":
+			return 0, true
+		case "max-age":
+			if v, err := strconv.Atoi(value); err == nil {
+				maxAge = v
+			}
+		case "s-maxage":
+			if v, err := strconv.Atoi(value); err == nil {
+				sMaxAge = v
+			}
+		}
+	}
+
+	// We are a shared cache.
+	if sMaxAge >= 0 {
+		return time.Duration(sMaxAge) * time.Second, true
+	}
+
+	if maxAge >= 0 {
+		return time.Duration(maxAge) * time.Second, true
+	}
+
+	if expiresStr := respHeader.Get("Expires"); expiresStr != "" {
+		expires, err := http.ParseTime(expiresStr)
+		if err != nil {
+			// Invalid dates, e.g. "0", means already expired.
+			return 0, true
+		}
+
+		date, err := http.ParseTime(respHeader.Get("Date"))
+		if err != nil {
+			date = now
+		}
+
+		return expires.Sub(date), true
+	}
+
+	return 0, false
+}
+
+// isStorable reports whether a shared cache like us may store a response
+// with the given headers. Those marked no-store or private are only passed
+// on to the client.
+func isStorable(respHeader http.Header) bool {
+	for _, directive := range strings.Split(respHeader.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if i := strings.Index(directive, "="); i != -1 {
+			directive = directive[:i]
+		}
+
+		switch directive {
+		case "no-store", "private":
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *fileMeta) isStale(now time.Time) bool {
+	return !m.Expires.IsZero() && now.After(m.Expires)
+}
+
+// staleWithin reports whether m is stale, but by less than the given window.
+func (m *fileMeta) staleWithin(now time.Time, window time.Duration) bool {
+	return window > 0 && m.isStale(now) && !now.After(m.Expires.Add(window))
+}
+
+// revalidated returns a copy of m updated with the headers and
+// expiry from a 304 Not Modified response from the origin.
+func (m fileMeta) revalidated(notModified *fileMeta) *fileMeta {
+	h := make(header)
+	for k, v := range m.Header {
+		h[k] = v
+	}
+	for k, v := range notModified.Header {
+		h[k] = v
+	}
+
+	m.Header = h
+	m.ModTime = lastModified(h, m.ModTime)
+	m.Expires = notModified.Expires
+	if notModified.Tags != nil {
+		m.Tags = notModified.Tags
+	}
+	m.OriginURL = notModified.OriginURL
+
+	return &m
+}
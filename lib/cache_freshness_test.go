@@ -0,0 +1,97 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostExpiresAt(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+
+	for i, test := range []struct {
+		defaultTTL time.Duration
+		maxTTL     time.Duration
+		header     map[string]string
+		expect     time.Duration // -1 means never
+	}{
+		{0, 0, nil, -1},
+		{time.Hour, 0, nil, time.Hour},
+		{0, time.Hour, nil, time.Hour},
+		{0, 0, map[string]string{"Cache-Control": "max-age=60"}, time.Minute},
+		{0, 0, map[string]string{"Cache-Control": "public, max-age=60, s-maxage=120"}, 2 * time.Minute},
+		{0, 30 * time.Second, map[string]string{"Cache-Control": "max-age=60"}, 30 * time.Second},
+		{time.Hour, 0, map[string]string{"Cache-Control": "no-cache"}, 0},
+		{0, 0, map[string]string{"Expires": now.Add(time.Hour).Format(http.TimeFormat), "Date": date}, time.Hour},
+		{0, 0, map[string]string{"Expires": "0"}, 0},
+		{0, 0, map[string]string{"Expires": now.Add(-time.Hour).Format(http.TimeFormat), "Date": date}, 0},
+		{0, 0, map[string]string{"Cache-Control": "max-age=60", "Expires": now.Add(time.Hour).Format(http.TimeFormat)}, time.Minute},
+	} {
+		h := Host{DefaultTTL: duration{test.defaultTTL}, MaxTTL: duration{test.maxTTL}}
+		respHeader := make(http.Header)
+		for k, v := range test.header {
+			respHeader.Set(k, v)
+		}
+
+		expires := h.expiresAt(respHeader, now)
+
+		if test.expect < 0 {
+			assert.True(expires.IsZero(), "[%d]", i)
+		} else {
+			assert.Equal(now.Add(test.expect), expires, "[%d]", i)
+		}
+	}
+}
+
+func TestHostNegativeExpiresAt(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	long := http.Header{"Cache-Control": {"max-age=3600"}}
+	short := http.Header{"Cache-Control": {"max-age=5"}}
+
+	assert.Equal(now.Add(time.Minute), Host{}.negativeExpiresAt(nil, now))
+	assert.Equal(now.Add(time.Minute), Host{}.negativeExpiresAt(long, now))
+	assert.Equal(now.Add(5*time.Second), Host{}.negativeExpiresAt(short, now))
+	assert.Equal(now.Add(10*time.Second), Host{NegativeTTL: duration{10 * time.Second}}.negativeExpiresAt(nil, now))
+}
+
+func TestIsStorable(t *testing.T) {
+	assert := require.New(t)
+
+	for _, test := range []struct {
+		cacheControl string
+		expect       bool
+	}{
+		{"", true},
+		{"max-age=60", true},
+		{"no-cache", true},
+		{"public, s-maxage=60", true},
+		{"no-store", false},
+		{"private", false},
+		{"Private, max-age=60", false},
+		{`private="Set-Cookie"`, false},
+	} {
+		assert.Equal(test.expect, isStorable(http.Header{"Cache-Control": {test.cacheControl}}), test.cacheControl)
+	}
+}
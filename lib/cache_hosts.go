@@ -0,0 +1,136 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// hostPartition is a host's share of the cache.
+type hostPartition struct {
+	// Where the files are stored.
+	dir string
+
+	// Where the metadata is stored.
+	meta metaStore
+
+	usage cacheUsage
+}
+
+// newHostPartitions creates a partition for every host. Hosts share the
+// cache directory and the root of the metadata store unless configured
+// otherwise.
+func newHostPartitions(cfg Config, meta metaStore) (map[string]*hostPartition, error) {
+	var (
+		partitions = make(map[string]*hostPartition)
+		buckets    = make(map[string]metaStore)
+	)
+
+	for name, host := range cfg.Hosts {
+		p := &hostPartition{dir: cfg.CacheDir, meta: meta}
+
+		if host.CacheDir != "" {
+			if filepath.IsAbs(host.CacheDir) {
+				p.dir = host.CacheDir
+			} else {
+				p.dir = filepath.Join(cfg.CacheDir, host.CacheDir)
+			}
+		}
+
+		if host.MetaBucket != "" {
+			b, found := buckets[host.MetaBucket]
+			if !found {
+				var err error
+				b, err = meta.bucket(host.MetaBucket)
+				if err != nil {
+					return nil, err
+				}
+				buckets[host.MetaBucket] = b
+			}
+			p.meta = b
+		}
+
+		partitions[name] = p
+	}
+
+	return partitions, nil
+}
+
+// hostName returns the host name part of the cache filename.
+func hostName(filename string) string {
+	return strings.SplitN(filename, "/", 2)[0]
+}
+
+// metaFor returns the metadata store to use for the given cache filename
+// or prefix.
+func (c *cache) metaFor(filename string) metaStore {
+	if p, found := c.hosts[hostName(filename)]; found {
+		return p.meta
+	}
+	return c.meta
+}
+
+// metaStores returns the root metadata store and all the host buckets.
+func (c *cache) metaStores() []metaStore {
+	stores := []metaStore{c.meta}
+
+	for _, p := range c.hosts {
+		seen := false
+		for _, s := range stores {
+			if s == p.meta {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			stores = append(stores, p.meta)
+		}
+	}
+
+	return stores
+}
+
+// walkAll calls fn for all records in all the metadata stores until fn
+// returns false.
+func (c *cache) walkAll(fn func(m fileMeta) bool) error {
+	done := false
+	for _, s := range c.metaStores() {
+		err := s.walk(func(m fileMeta) bool {
+			done = !fn(m)
+			return !done
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+// osFilename returns the location on disk of the given cache filename.
+func (c *cache) osFilename(filename string) string {
+	dir := c.cfg.CacheDir
+	if p, found := c.hosts[hostName(filename)]; found {
+		dir = p.dir
+	}
+	return filepath.Join(dir, filepath.FromSlash(filename))
+}
+
+func (c *cache) addUsage(filename string, size, files int64) {
+	c.usage.add(size, files)
+	if p, found := c.hosts[hostName(filename)]; found {
+		p.usage.add(size, files)
+	}
+}
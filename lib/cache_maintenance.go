@@ -16,107 +16,318 @@ package lib
 
 import (
 	"os"
-	"path/filepath"
+	"sync/atomic"
 	"time"
-
-	"github.com/asdine/storm"
-	"github.com/asdine/storm/q"
 )
 
-func (c *cache) purgePrefix(prefix string) error {
-	db, err := c.openDB()
+func (c *cache) purgePrefix(prefix string) (int, error) {
+	files, err := c.metaFor(prefix).withPrefix(prefix)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer db.Close()
 
-	// TODO(bep) remove
-	var all []fileMeta
-	db.All(&all)
-	for _, a := range all {
-		c.logger.Debug("file", a.Filename)
+	c.logger.Info("area", "cache", "tag", "purge", "prefix", prefix, "count", len(files), "time", time.Now())
+
+	for i, file := range files {
+		if err := c.removeFile(file); err != nil {
+			return i, err
+		}
 	}
 
-	// TODO(bep) a way to do this with an index.
-	q := db.Select(q.Re("Filename", "^"+prefix))
+	return len(files), nil
+}
+
+// cacheLimits holds the maximum size and file count of the cache.
+// Zero means no limit.
+type cacheLimits struct {
+	size  int64
+	files int64
+}
 
-	var files []fileMeta
+func (l cacheLimits) isZero() bool {
+	return l.size == 0 && l.files == 0
+}
 
-	if err := q.Find(&files); err != nil && err != storm.ErrNotFound {
-		return err
+func (l cacheLimits) scale(f float64) cacheLimits {
+	return cacheLimits{size: int64(float64(l.size) * f), files: int64(float64(l.files) * f)}
+}
+
+// exceededBy reports whether the given size and file count is above the limits.
+func (l cacheLimits) exceededBy(size, files int64) bool {
+	return l.size > 0 && size > l.size || l.files > 0 && files > l.files
+}
+
+// watermarks returns the global limits where eviction should start and stop.
+func (c Config) watermarks() (high, low cacheLimits) {
+	return c.watermarksFor(cacheLimits{size: int64(c.MaxCacheSize), files: int64(c.MaxCacheFiles)})
+}
+
+// hostWatermarks returns the limits for the host's share of the cache.
+func (c Config) hostWatermarks(h Host) (high, low cacheLimits) {
+	return c.watermarksFor(cacheLimits{size: int64(h.MaxCacheSize), files: int64(h.MaxCacheFiles)})
+}
+
+func (c Config) watermarksFor(limits cacheLimits) (high, low cacheLimits) {
+	var (
+		h = c.CacheHighWatermark
+		l = c.CacheLowWatermark
+	)
+
+	if h <= 0 {
+		h = 1
+	}
+	if l <= 0 {
+		l = 0.9
+	}
+	if l > h {
+		l = h
 	}
 
-	c.logger.Info("area", "cache", "tag", "purge", "prefix", prefix, "count", len(files), "time", time.Now())
+	return limits.scale(h), limits.scale(l)
+}
 
-	for _, file := range files {
-		if err := db.DeleteStruct(&file); err != nil && err != storm.ErrNotFound {
-			return err
+// cacheUsage is the size of the cache. It is kept up to date on fills and
+// removals and recounted on every shrink.
+type cacheUsage struct {
+	size  int64
+	files int64
+}
+
+func (u *cacheUsage) add(size, files int64) {
+	atomic.AddInt64(&u.size, size)
+	atomic.AddInt64(&u.files, files)
+}
+
+func (u *cacheUsage) set(size, files int64) {
+	atomic.StoreInt64(&u.size, size)
+	atomic.StoreInt64(&u.files, files)
+}
+
+func (u *cacheUsage) get() (size, files int64) {
+	return atomic.LoadInt64(&u.size), atomic.LoadInt64(&u.files)
+}
+
+type shrinkStats struct {
+	files int
+	bytes int64
+}
+
+func (s *shrinkStats) add(other shrinkStats) {
+	s.files += other.files
+	s.bytes += other.bytes
+}
+
+// enforceLimits shrinks the hosts over their quota and then the cache to
+// the low watermarks if they are above the high watermarks. If recount is
+// set, the current usage is read from the metadata store first.
+func (c *cache) enforceLimits(recount bool) (shrinkStats, error) {
+	if recount {
+		if err := c.recountUsage(); err != nil {
+			return shrinkStats{}, err
 		}
 	}
 
-	return nil
+	stats, err := c.shrinkHosts()
+	if err != nil {
+		return stats, err
+	}
+
+	high, low := c.cfg.watermarks()
+	if high.isZero() || !high.exceededBy(c.usage.get()) {
+		return stats, nil
+	}
+
+	s, err := c.shrinkCacheTo(low)
+	stats.add(s)
+
+	return stats, err
 }
 
-// This is a Least Recently Used (LRU) cache.
-// So: Sort by created and delete until we reach the target.
-func (c *cache) shrinkTo(target int64) error {
-	db, err := c.openDB()
+func (c *cache) recountUsage() error {
+	var (
+		size, files int64
+		hosts       = make(map[string]cacheUsage)
+	)
+
+	err := c.walkAll(func(m fileMeta) bool {
+		size += m.Size
+		files++
+
+		u := hosts[hostName(m.Filename)]
+		u.size += m.Size
+		u.files++
+		hosts[hostName(m.Filename)] = u
+
+		return true
+	})
 	if err != nil {
 		return err
 	}
-	defer db.Close()
 
-	var files []fileMeta
+	c.usage.set(size, files)
+	for name, p := range c.hosts {
+		u := hosts[name]
+		p.usage.set(u.size, u.files)
+	}
 
-	err = db.AllByIndex("CreatedAt", &files)
-	if err != nil {
-		if err == storm.ErrNotFound {
-			return nil
+	return nil
+}
+
+// shrinkHosts shrinks the hosts above their high watermark to their low
+// watermark.
+func (c *cache) shrinkHosts() (shrinkStats, error) {
+	var stats shrinkStats
+
+	for name, p := range c.hosts {
+		high, low := c.cfg.hostWatermarks(c.cfg.Hosts[name])
+		if high.isZero() || !high.exceededBy(p.usage.get()) {
+			continue
 		}
-		return err
+
+		s, err := c.shrinkHostTo(name, low)
+		stats.add(s)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// shrinkHostTo evicts the host's cache entries in the order given by the
+// configured eviction policy until its share is within the given limits.
+func (c *cache) shrinkHostTo(name string, target cacheLimits) (shrinkStats, error) {
+	p := c.hosts[name]
+
+	if err := c.flushAccess(); err != nil {
+		return shrinkStats{}, err
+	}
+
+	files, err := p.meta.withPrefix(name + "/")
+	if err != nil {
+		return shrinkStats{}, err
+	}
+
+	var totalSize int64
+	for _, m := range files {
+		totalSize += m.Size
+	}
+
+	p.usage.set(totalSize, int64(len(files)))
+
+	stats, err := c.evict(files, totalSize, target)
+	if stats.files > 0 {
+		c.logger.Info("area", "cache", "tag", "shrink", "host", name,
+			"evicted_files", stats.files, "evicted_bytes", stats.bytes)
+	}
+
+	return stats, err
+}
+
+// shrinkTo evicts cache entries in the order given by the configured
+// eviction policy until the cache is within the given limits. Hosts over
+// their quota are shrunk first.
+func (c *cache) shrinkTo(target cacheLimits) (shrinkStats, error) {
+	stats, err := c.shrinkHosts()
+	if err != nil {
+		return stats, err
+	}
+
+	s, err := c.shrinkCacheTo(target)
+	stats.add(s)
+
+	return stats, err
+}
+
+// shrinkCacheTo is shrinkTo without the per host quotas.
+func (c *cache) shrinkCacheTo(target cacheLimits) (shrinkStats, error) {
+	// Make sure the policy sees the latest hits.
+	if err := c.flushAccess(); err != nil {
+		return shrinkStats{}, err
 	}
 
 	var (
-		totalSize int64 = 0
-		fileCount       = 0
+		totalSize int64
+		files     []fileMeta
 	)
 
-	for _, f := range files {
-		totalSize += f.Size
-		fileCount++
+	err := c.walkAll(func(m fileMeta) bool {
+		totalSize += m.Size
+		files = append(files, m)
+		return true
+	})
+	if err != nil {
+		return shrinkStats{}, err
 	}
 
+	c.usage.set(totalSize, int64(len(files)))
+
 	c.logger.Debug("area", "cache", "tag", "shrink",
-		"target", target,
-		"total", totalSize, "files", fileCount)
+		"target_size", target.size, "target_files", target.files,
+		"total", totalSize, "files", len(files))
 
-	if totalSize <= target {
-		return nil
-	}
+	stats, err := c.evict(files, totalSize, target)
 
-	toDelete := totalSize - target
+	if stats.files > 0 {
+		c.logger.Info("area", "cache", "tag", "shrink",
+			"evicted_files", stats.files, "evicted_bytes", stats.bytes,
+			"total", totalSize-stats.bytes, "files", len(files)-stats.files)
+	}
 
-	for i, file := range files {
-		if err := db.DeleteStruct(&file); err != nil && err != storm.ErrNotFound {
-			return err
-		}
+	return stats, err
+}
 
-		osFilename := filepath.Join(c.cfg.CacheDir, filepath.FromSlash(file.Filename))
+// evict removes files, in the order given by the eviction policy, until
+// the total is within the target.
+func (c *cache) evict(files []fileMeta, totalSize int64, target cacheLimits) (shrinkStats, error) {
+	var (
+		stats      shrinkStats
+		totalFiles = int64(len(files))
+	)
 
-		if err := os.Remove(osFilename); err != nil && !os.IsNotExist(err) {
-			return err
-		}
+	if !target.exceededBy(totalSize, totalFiles) {
+		return stats, nil
+	}
 
-		toDelete -= file.Size
+	c.evictionOrder(files)
 
-		if toDelete <= 0 {
-			c.logger.Debug("area", "cache", "tag", "shrink",
-				"deleted", (i + 1))
+	for _, file := range files {
+		if !target.exceededBy(totalSize, totalFiles) {
 			break
 		}
+
+		if err := c.removeFile(file); err != nil {
+			return stats, err
+		}
+
+		totalSize -= file.Size
+		totalFiles--
+		stats.files++
+		stats.bytes += file.Size
 	}
 
-	return nil
+	return stats, nil
 }
 
-// TODO(bep) Handle leftover directories
+// removeFile removes both the metadata and the cached file on disk.
+func (c *cache) removeFile(m fileMeta) error {
+	removed, err := c.metaFor(m.Filename).delete(m.Filename)
+	if err != nil {
+		return err
+	}
+
+	if removed != nil {
+		// Not if someone else got to it first, e.g. a purge and an eviction.
+		c.addUsage(m.Filename, -removed.Size, -1)
+	}
+
+	if c.mem != nil {
+		c.mem.remove(m.Filename)
+	}
+
+	if err := os.Remove(c.osFilename(m.Filename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,239 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachePurgePrefix(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects: map[string]string{
+			"/a.b/index.html": "dot",
+			"/axb/index.html": "x",
+			"/a+b/index.html": "plus",
+			"/ab/index.html":  "ab",
+		},
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	for p := range s3.objects {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org"+p, nil)))
+		assert.Equal(http.StatusOK, rec.Code)
+	}
+
+	host := c.cfg.Hosts["example.org"]
+
+	exists := func(urlPath string) bool {
+		relPath := host.hostPath(urlPath)
+		meta, err := c.getFileMeta(relPath)
+		assert.NoError(err)
+		_, err = os.Stat(filepath.Join(c.cfg.CacheDir, filepath.FromSlash(relPath)))
+		assert.Equal(meta != nil, err == nil, urlPath)
+		return meta != nil
+	}
+
+	purge := func(prefix string) int {
+		count, err := c.purgePrefix(host.purgePrefix(prefix))
+		assert.NoError(err)
+		return count
+	}
+
+	// Regexp meta characters must be matched literally.
+	assert.Equal(1, purge("/a.b/"))
+	assert.False(exists("/a.b/index.html"))
+	assert.True(exists("/axb/index.html"))
+
+	assert.Equal(1, purge("/a+b/"))
+	assert.False(exists("/a+b/index.html"))
+	assert.True(exists("/ab/index.html"))
+
+	assert.Equal(2, purge(""))
+	assert.False(exists("/axb/index.html"))
+	assert.False(exists("/ab/index.html"))
+}
+
+func TestCacheEnforceLimits(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects: map[string]string{
+			"/a.html": "aaaaaaaaaa",
+			"/b.html": "bbbbbbbbbb",
+			"/c.html": "cccccccccc",
+			"/d.html": "dddddddddd",
+		},
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	c.cfg.MaxCacheFiles = 3
+	c.cfg.CacheLowWatermark = 0.5
+
+	get := func(p string) {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org"+p, nil)))
+		assert.Equal(http.StatusOK, rec.Code)
+	}
+
+	for _, p := range []string{"/a.html", "/b.html", "/c.html"} {
+		get(p)
+	}
+
+	size, files := c.usage.get()
+	assert.Equal(int64(30), size)
+	assert.Equal(int64(3), files)
+
+	// At the high watermark.
+	stats, err := c.enforceLimits(false)
+	assert.NoError(err)
+	assert.Equal(0, stats.files)
+
+	get("/d.html")
+	<-c.filled
+
+	// Down to the low watermark, 1.5 files.
+	stats, err = c.enforceLimits(false)
+	assert.NoError(err)
+	assert.Equal(3, stats.files)
+	assert.Equal(int64(30), stats.bytes)
+
+	size, files = c.usage.get()
+	assert.Equal(int64(10), size)
+	assert.Equal(int64(1), files)
+
+	// Recount picks up changes made behind our back.
+	c.usage.set(1000, 1000)
+	stats, err = c.enforceLimits(true)
+	assert.NoError(err)
+	assert.Equal(0, stats.files)
+	size, files = c.usage.get()
+	assert.Equal(int64(10), size)
+	assert.Equal(int64(1), files)
+
+	// Removing the same entry twice, e.g. a purge racing an eviction,
+	// only counts once.
+	var last fileMeta
+	assert.NoError(c.walkAll(func(m fileMeta) bool {
+		last = m
+		return false
+	}))
+	assert.NoError(c.removeFile(last))
+	assert.NoError(c.removeFile(last))
+	size, files = c.usage.get()
+	assert.Equal(int64(0), size)
+	assert.Equal(int64(0), files)
+}
+
+func TestConfigWatermarks(t *testing.T) {
+	assert := require.New(t)
+
+	high, low := Config{}.watermarks()
+	assert.True(high.isZero())
+	assert.True(low.isZero())
+
+	high, low = Config{MaxCacheSize: 1000, MaxCacheFiles: 100}.watermarks()
+	assert.Equal(cacheLimits{size: 1000, files: 100}, high)
+	assert.Equal(cacheLimits{size: 900, files: 90}, low)
+
+	high, low = Config{MaxCacheSize: 1000, CacheHighWatermark: 0.8, CacheLowWatermark: 0.5}.watermarks()
+	assert.Equal(cacheLimits{size: 800}, high)
+	assert.Equal(cacheLimits{size: 500}, low)
+
+	assert.True(high.exceededBy(801, 0))
+	assert.False(high.exceededBy(800, 1e6))
+}
+
+func TestCacheHostQuotas(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects: map[string]string{
+			"/a.html": "aaaaaaaaaa",
+			"/b.html": "bbbbbbbbbb",
+			"/c.html": "cccccccccc",
+		},
+	}
+
+	c, clean := newTestCacheWithConfig(t, s3, func(cfg *Config) {
+		cfg.Hosts["example.com"] = Host{
+			Name: "example.com", Bucket: "bucket2", AccessKey: "ak", SecretKey: "sk",
+			MaxCacheFiles: 2, CacheDir: "com", MetaBucket: "com",
+		}
+	})
+	defer clean()
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	get := func(host, p string) {
+		now = now.Add(time.Minute)
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://"+host+p, nil)))
+		assert.Equal(http.StatusOK, rec.Code)
+	}
+
+	cached := func(relPath string) bool {
+		meta, err := c.getFileMeta(relPath)
+		assert.NoError(err)
+		_, err = os.Stat(c.osFilename(relPath))
+		assert.Equal(meta != nil, err == nil, relPath)
+		return meta != nil
+	}
+
+	for _, p := range []string{"/a.html", "/b.html", "/c.html"} {
+		get("example.com", p)
+	}
+	get("example.org", "/a.html")
+	get("example.org", "/b.html")
+
+	// Isolated from the other hosts.
+	assert.Equal(filepath.Join(c.cfg.CacheDir, "com", "example.com", "bucket2", "a.html"), c.osFilename("example.com/bucket2/a.html"))
+	meta, err := c.meta.get("example.com/bucket2/a.html")
+	assert.NoError(err)
+	assert.Nil(meta)
+
+	// example.com is over its quota, example.org is not, even if it has the
+	// least recently used files.
+	stats, err := c.enforceLimits(false)
+	assert.NoError(err)
+	assert.Equal(2, stats.files)
+	assert.False(cached("example.com/bucket2/a.html"))
+	assert.False(cached("example.com/bucket2/b.html"))
+	assert.True(cached("example.com/bucket2/c.html"))
+	assert.True(cached("example.org/bucket1/a.html"))
+
+	// The global limit still applies.
+	c.cfg.MaxCacheFiles = 2
+	stats, err = c.enforceLimits(true)
+	assert.NoError(err)
+	assert.Equal(2, stats.files)
+	assert.False(cached("example.com/bucket2/c.html"))
+	assert.False(cached("example.org/bucket1/a.html"))
+	assert.True(cached("example.org/bucket1/b.html"))
+}
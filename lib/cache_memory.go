@@ -0,0 +1,145 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+)
+
+// Default for Config.MemoryCacheMaxObjectSize.
+const defaultMemoryCacheMaxObjectSize = 1 << 20
+
+// The number of generation counters, see memoryTier.generation.
+const memoryGenerations = 256
+
+// memoryTier keeps the most recently used small objects in memory, so
+// they can be served without touching the disk or the metadata store.
+type memoryTier struct {
+	maxSize       int64
+	maxObjectSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // Of *memoryEntry, the most recently used first.
+	entries map[string]*list.Element
+
+	// Bumped on every remove, shared by the keys with the same hash so
+	// we don't need one for every key ever seen.
+	generations [memoryGenerations]uint64
+}
+
+type memoryEntry struct {
+	meta fileMeta
+	body []byte
+}
+
+// newMemoryTier returns nil if the memory tier is disabled.
+func newMemoryTier(cfg Config) *memoryTier {
+	if cfg.MemoryCacheSize <= 0 {
+		return nil
+	}
+
+	maxObjectSize := int64(cfg.MemoryCacheMaxObjectSize)
+	if maxObjectSize <= 0 {
+		maxObjectSize = defaultMemoryCacheMaxObjectSize
+	}
+
+	return &memoryTier{
+		maxSize:       int64(cfg.MemoryCacheSize),
+		maxObjectSize: maxObjectSize,
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+}
+
+// fits reports whether an object of the given size can be kept in memory.
+func (t *memoryTier) fits(size int64) bool {
+	return size >= 0 && size <= t.maxObjectSize && size <= t.maxSize
+}
+
+func (t *memoryTier) get(filename string) *memoryEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	el, found := t.entries[filename]
+	if !found {
+		return nil
+	}
+
+	t.lru.MoveToFront(el)
+
+	return el.Value.(*memoryEntry)
+}
+
+// generation returns the current generation of filename. Get it before
+// reading the object's metadata and pass it to put, so an object removed
+// or replaced in the meantime is not put back.
+func (t *memoryTier) generation(filename string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.generations[generationIndex(filename)]
+}
+
+func generationIndex(filename string) int {
+	h := fnv.New32a()
+	h.Write([]byte(filename))
+	return int(h.Sum32() % memoryGenerations)
+}
+
+// put keeps the object in memory unless it has been removed since the
+// given generation.
+func (t *memoryTier) put(meta fileMeta, body []byte, generation uint64) {
+	if !t.fits(int64(len(body))) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.generations[generationIndex(meta.Filename)] != generation {
+		return
+	}
+
+	t.removeLocked(meta.Filename)
+
+	t.entries[meta.Filename] = t.lru.PushFront(&memoryEntry{meta: meta, body: body})
+	t.size += int64(len(body))
+
+	for t.size > t.maxSize {
+		t.removeLocked(t.lru.Back().Value.(*memoryEntry).meta.Filename)
+	}
+}
+
+// remove removes the object, and makes sure it is not put back from
+// a read that started before this.
+func (t *memoryTier) remove(filename string) {
+	t.mu.Lock()
+	t.generations[generationIndex(filename)]++
+	t.removeLocked(filename)
+	t.mu.Unlock()
+}
+
+func (t *memoryTier) removeLocked(filename string) {
+	el, found := t.entries[filename]
+	if !found {
+		return
+	}
+
+	t.lru.Remove(el)
+	delete(t.entries, filename)
+	t.size -= int64(len(el.Value.(*memoryEntry).body))
+}
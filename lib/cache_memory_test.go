@@ -0,0 +1,144 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryTier(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Nil(newMemoryTier(Config{}))
+
+	tier := newMemoryTier(Config{MemoryCacheSize: 10, MemoryCacheMaxObjectSize: 5})
+
+	assert.True(tier.fits(5))
+	assert.False(tier.fits(6))
+
+	put := func(filename, body string) {
+		tier.put(fileMeta{Filename: filename, Size: int64(len(body))}, []byte(body), tier.generation(filename))
+	}
+
+	put("a", "aaa")
+	put("b", "bbb")
+	put("big", "bigbig")
+	assert.Nil(tier.get("big"))
+
+	// a is now the most recently used.
+	assert.Equal("aaa", string(tier.get("a").body))
+
+	put("c", "ccc")
+	put("d", "ddd")
+	assert.Nil(tier.get("b"))
+	assert.NotNil(tier.get("a"))
+	assert.NotNil(tier.get("c"))
+	assert.NotNil(tier.get("d"))
+	assert.Equal(int64(9), tier.size)
+
+	// Replace.
+	put("a", "a")
+	assert.Equal("a", string(tier.get("a").body))
+	assert.Equal(int64(7), tier.size)
+
+	tier.remove("a")
+	assert.Nil(tier.get("a"))
+	assert.Equal(int64(6), tier.size)
+
+	// Removed while it was read.
+	generation := tier.generation("a")
+	tier.remove("a")
+	tier.put(fileMeta{Filename: "a", Size: 1}, []byte("a"), generation)
+	assert.Nil(tier.get("a"))
+}
+
+func TestCacheMemoryTier(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects:      map[string]string{"/index.html": "v1"},
+		cacheControl: "max-age=60",
+	}
+
+	c, clean := newTestCacheWithConfig(t, s3, func(cfg *Config) {
+		cfg.MemoryCacheSize = 1 << 10
+	})
+	defer clean()
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil)))
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal("text/html", rec.Header().Get("Content-Type"))
+		return rec.Body.String()
+	}
+
+	assert.Equal("v1", get())
+	assert.Nil(c.mem.get("example.org/bucket1/index.html"))
+
+	// Read from disk once.
+	assert.Equal("v1", get())
+	assert.NotNil(c.mem.get("example.org/bucket1/index.html"))
+
+	// From now on, the disk is not needed.
+	filename := c.osFilename("example.org/bucket1/index.html")
+	assert.NoError(os.Remove(filename))
+	assert.Equal("v1", get())
+	assert.Equal(int32(1), s3.requests)
+
+	// Purged.
+	_, err := c.purgePrefix("example.org/")
+	assert.NoError(err)
+	assert.Nil(c.mem.get("example.org/bucket1/index.html"))
+	assert.Equal("v1", get())
+	assert.Equal(int32(2), s3.requests)
+
+	// Stale objects are not served from memory.
+	assert.Equal("v1", get())
+	assert.NotNil(c.mem.get("example.org/bucket1/index.html"))
+	s3.objects["/index.html"] = "v2"
+	now = now.Add(2 * time.Minute)
+	assert.Equal("v2", get())
+	assert.Equal(int32(3), s3.requests)
+	assert.Nil(c.mem.get("example.org/bucket1/index.html"))
+
+	// Purged while it is read from disk, as in handleRequest.
+	relPath := "example.org/bucket1/index.html"
+	generation := c.mem.generation(relPath)
+	meta, err := c.getFileMeta(relPath)
+	assert.NoError(err)
+	f, err := c.getFile(relPath)
+	assert.NoError(err)
+	_, err = c.purgePrefix("example.org/")
+	assert.NoError(err)
+	body, err := ioutil.ReadAll(f)
+	f.Close()
+	assert.NoError(err)
+	c.mem.put(*meta, body, generation)
+	assert.Nil(c.mem.get(relPath))
+
+	assert.Equal("v2", get())
+	assert.Equal(int32(4), s3.requests)
+}
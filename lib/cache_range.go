@@ -0,0 +1,161 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rangeSpec is a single byte range from a Range header. For suffix ranges,
+// e.g. "bytes=-500", first is -1 and last is the suffix length. For open
+// ranges, e.g. "bytes=500-", last is -1.
+type rangeSpec struct {
+	first, last int64
+}
+
+// parseRange parses a Range header with a single byte range. Anything else,
+// including multiple ranges, is reported as not ok and should be ignored.
+func parseRange(s string) (r rangeSpec, ok bool) {
+	const prefix = "bytes="
+
+	if !strings.HasPrefix(s, prefix) || strings.Contains(s, ",") {
+		return r, false
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(s[len(prefix):]), "-", 2)
+	if len(parts) != 2 {
+		return r, false
+	}
+
+	first, last := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+	parse := func(s string) int64 {
+		if s == "" {
+			return -1
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v < 0 {
+			return -2
+		}
+		return v
+	}
+
+	r.first, r.last = parse(first), parse(last)
+
+	switch {
+	case r.first == -2 || r.last == -2:
+		return r, false
+	case r.first == -1 && r.last <= 0:
+		return r, false
+	case r.last >= 0 && r.first > r.last:
+		return r, false
+	}
+
+	return r, true
+}
+
+// resolve returns the first and last byte of the range in an object of the
+// given size, or false if the range cannot be satisfied.
+func (r rangeSpec) resolve(size int64) (start, end int64, ok bool) {
+	switch {
+	case r.first == -1:
+		start = size - r.last
+		if start < 0 {
+			start = 0
+		}
+		end = size - 1
+	case r.first >= size:
+		return 0, 0, false
+	default:
+		start, end = r.first, r.last
+		if end < 0 || end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end, size > 0
+}
+
+func (r rangeSpec) String() string {
+	switch {
+	case r.first == -1:
+		return fmt.Sprintf("bytes=-%d", r.last)
+	case r.last == -1:
+		return fmt.Sprintf("bytes=%d-", r.first)
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.first, r.last)
+}
+
+// parseContentRange parses a Content-Range header, e.g. "bytes 0-99/1000".
+func parseContentRange(s string) (start, end, size int64, err error) {
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	if start > end || end >= size {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return start, end, size, nil
+}
+
+// proxyRange forwards the range request to the origin without caching
+// anything. This is used on cache misses when chunked caching is disabled,
+// so seeking in a large file does not download all of it.
+func (c *cache) proxyRange(rw http.ResponseWriter, urlPath string, host Host, r rangeSpec) error {
+	resp, err := c.origins[host.Name].Get(host.bucketPath(urlPath), http.Header{"Range": {r.String()}})
+	if err != nil {
+		return upstreamError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		var size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size); err != nil {
+			return upstreamStatusError(urlPath, resp.StatusCode)
+		}
+		// Without the origin's error document.
+		return writeRangeNotSatisfiable(rw, size)
+	case http.StatusNotFound:
+		return statusError{status: http.StatusNotFound, err: fmt.Errorf("%s: %d from origin", urlPath, resp.StatusCode)}
+	default:
+		return upstreamStatusError(urlPath, resp.StatusCode)
+	}
+
+	// The same headers as we would serve from the cache.
+	meta := newFileMeta(host.hostPath(urlPath), resp)
+	c.setTags(meta)
+
+	for k, v := range meta.Header {
+		for _, vv := range v {
+			rw.Header().Add(k, vv)
+		}
+	}
+
+	if v := resp.Header.Get("Content-Length"); v != "" {
+		rw.Header().Set("Content-Length", v)
+	}
+	rw.Header().Set("Accept-Ranges", "bytes")
+
+	rw.WriteHeader(resp.StatusCode)
+
+	_, err = io.Copy(rw, resp.Body)
+
+	return err
+}
@@ -0,0 +1,281 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	assert := require.New(t)
+
+	for _, test := range []struct {
+		in         string
+		ok         bool
+		size       int64
+		start, end int64
+		resolved   bool
+	}{
+		{"bytes=0-99", true, 1000, 0, 99, true},
+		{"bytes=500-", true, 1000, 500, 999, true},
+		{"bytes=-100", true, 1000, 900, 999, true},
+		{"bytes=-2000", true, 1000, 0, 999, true},
+		{"bytes=900-2000", true, 1000, 900, 999, true},
+		{"bytes=1000-", true, 1000, 0, 0, false},
+		{"bytes=0-0", true, 0, 0, 0, false},
+		{"bytes=0-1,5-6", false, 0, 0, 0, false},
+		{"bytes=5-1", false, 0, 0, 0, false},
+		{"bytes=-0", false, 0, 0, 0, false},
+		{"bytes=a-b", false, 0, 0, 0, false},
+		{"items=0-1", false, 0, 0, 0, false},
+		{"", false, 0, 0, 0, false},
+	} {
+		r, ok := parseRange(test.in)
+		assert.Equal(test.ok, ok, test.in)
+		if !ok {
+			continue
+		}
+		assert.Equal(test.in, r.String())
+		start, end, resolved := r.resolve(test.size)
+		assert.Equal(test.resolved, resolved, test.in)
+		if resolved {
+			assert.Equal(test.start, start, test.in)
+			assert.Equal(test.end, end, test.in)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	assert := require.New(t)
+
+	start, end, size, err := parseContentRange("bytes 10-19/100")
+	assert.NoError(err)
+	assert.Equal([]int64{10, 19, 100}, []int64{start, end, size})
+
+	for _, s := range []string{"", "bytes */100", "bytes 10-5/100", "bytes 0-100/100"} {
+		_, _, _, err = parseContentRange(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestCacheChunkedRange(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{objects: map[string]string{"/video.mp4": "0123456789abcdefghij"}}
+
+	c, clean := newTestCacheWithConfig(t, s3, func(cfg *Config) {
+		cfg.ChunkSize = 8
+	})
+	defer clean()
+
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.org/video.mp4", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, req))
+		return rec
+	}
+
+	rec := get("bytes=10-12")
+	assert.Equal(http.StatusPartialContent, rec.Code)
+	assert.Equal("abc", rec.Body.String())
+	assert.Equal("bytes 10-12/20", rec.Header().Get("Content-Range"))
+	assert.Equal("3", rec.Header().Get("Content-Length"))
+	assert.Equal([]string{"bytes=8-15"}, s3.ranges)
+
+	// Spans the first two chunks, only the first is fetched.
+	rec = get("bytes=6-9")
+	assert.Equal(http.StatusPartialContent, rec.Code)
+	assert.Equal("6789", rec.Body.String())
+	assert.Equal([]string{"bytes=8-15", "bytes=0-7"}, s3.ranges)
+
+	rec = get("bytes=-3")
+	assert.Equal(http.StatusPartialContent, rec.Code)
+	assert.Equal("hij", rec.Body.String())
+	assert.Equal("bytes 17-19/20", rec.Header().Get("Content-Range"))
+	assert.Equal([]string{"bytes=8-15", "bytes=0-7", "bytes=16-23"}, s3.ranges)
+
+	// Everything is cached now, also the full object.
+	rec = get("")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("0123456789abcdefghij", rec.Body.String())
+	assert.Equal("bytes", rec.Header().Get("Accept-Ranges"))
+	assert.Len(s3.ranges, 3)
+	assert.Equal(int32(3), s3.requests)
+
+	rec = get("bytes=30-")
+	assert.Equal(http.StatusRequestedRangeNotSatisfiable, rec.Code)
+	assert.Equal("bytes */20", rec.Header().Get("Content-Range"))
+
+	meta, err := c.getFileMeta(chunkPath("example.org/bucket1/video.mp4", 2))
+	assert.NoError(err)
+	assert.Equal(int64(4), meta.Size)
+	assert.Equal(int64(20), meta.ObjectSize)
+	assert.Empty(meta.Header.get("Content-Range"))
+
+	// A new version of the object is not mixed with the cached chunks.
+	assert.NoError(c.removeFile(*meta))
+	s3.objects["/video.mp4"] = "ABCDEFGHIJKLMNOPQRST"
+	req := httptest.NewRequest("GET", "http://example.org/video.mp4", nil)
+	req.Header.Set("Range", "bytes=14-17")
+	rec = httptest.NewRecorder()
+	assert.Equal(errObjectChanged, c.handleRequest(rec, req))
+	assert.Equal("ef", rec.Body.String())
+	meta, err = c.getFileMeta(chunkPath("example.org/bucket1/video.mp4", 0))
+	assert.NoError(err)
+	assert.Nil(meta)
+
+	rec = get("bytes=14-17")
+	assert.Equal("OPQR", rec.Body.String())
+	assert.Equal("ABCDEFGH", get("bytes=0-7").Body.String())
+}
+
+func TestCacheChunkedRangeThenFull(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{objects: map[string]string{"/video.mp4": "0123456789abcdefghij"}}
+
+	c, clean := newTestCacheWithConfig(t, s3, func(cfg *Config) {
+		cfg.ChunkSize = 8
+	})
+	defer clean()
+
+	req := httptest.NewRequest("GET", "http://example.org/video.mp4", nil)
+	req.Header.Set("Range", "bytes=10-12")
+	rec := httptest.NewRecorder()
+	assert.NoError(c.handleRequest(rec, req))
+	assert.Equal("abc", rec.Body.String())
+
+	// The full object is served from the chunks, not stored again as a whole.
+	rec = httptest.NewRecorder()
+	assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/video.mp4", nil)))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("0123456789abcdefghij", rec.Body.String())
+	assert.Equal([]string{"bytes=8-15", "bytes=0-7", "bytes=16-23"}, s3.ranges)
+
+	meta, err := c.getFileMeta("example.org/bucket1/video.mp4")
+	assert.NoError(err)
+	assert.Nil(meta)
+}
+
+func TestCacheProxyRange(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects: map[string]string{"/video.mp4": "0123456789"},
+		headers: map[string]http.Header{"/video.mp4": {"X-Amz-Meta-Surrogate-Key": {"video"}}},
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	req := httptest.NewRequest("GET", "http://example.org/video.mp4", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	rec := httptest.NewRecorder()
+	assert.NoError(c.handleRequest(rec, req))
+	assert.Equal(http.StatusPartialContent, rec.Code)
+	assert.Equal("234", rec.Body.String())
+	assert.Equal("bytes 2-4/10", rec.Header().Get("Content-Range"))
+	assert.Empty(rec.Header().Get("X-Amz-Meta-Surrogate-Key"))
+
+	unsatisfiable := httptest.NewRequest("GET", "http://example.org/video.mp4", nil)
+	unsatisfiable.Header.Set("Range", "bytes=20-")
+	rec = httptest.NewRecorder()
+	assert.NoError(c.handleRequest(rec, unsatisfiable))
+	assert.Equal(http.StatusRequestedRangeNotSatisfiable, rec.Code)
+	assert.Equal("bytes */10", rec.Header().Get("Content-Range"))
+
+	// Origin errors are not passed on as they are.
+	for status, expect := range map[int]int{
+		http.StatusForbidden:           http.StatusBadGateway,
+		http.StatusInternalServerError: http.StatusBadGateway,
+		http.StatusNotFound:            http.StatusNotFound,
+	} {
+		s3.failStatus = status
+		rec = httptest.NewRecorder()
+		err := c.handleRequest(rec, req)
+		assert.Error(err)
+		assert.Equal(expect, errorStatus(err))
+		assert.Empty(rec.Body.String())
+	}
+	s3.failStatus = 0
+
+	// Nothing is cached.
+	meta, err := c.getFileMeta("example.org/bucket1/video.mp4")
+	assert.NoError(err)
+	assert.Nil(meta)
+
+	rec = httptest.NewRecorder()
+	assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/video.mp4", nil)))
+	assert.Equal("0123456789", rec.Body.String())
+
+	// The cached object serves the ranges from now on.
+	rec = httptest.NewRecorder()
+	assert.NoError(c.handleRequest(rec, req))
+	assert.Equal(http.StatusPartialContent, rec.Code)
+	assert.Equal("234", rec.Body.String())
+	assert.Equal(int32(6), s3.requests)
+}
+
+func TestCacheChunkedRangeNotSupported(t *testing.T) {
+	assert := require.New(t)
+
+	var requests int32
+
+	// Answers every request with the full object.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("0123456789"))
+	}))
+	defer ts.Close()
+
+	c, clean := newTestCacheWithConfig(t, &fakeS3{}, func(cfg *Config) {
+		cfg.ChunkSize = 4
+	})
+	defer clean()
+
+	c.origins["example.org"] = httpOrigin{baseURL: ts.URL, client: http.DefaultClient}
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.org/video.mp4", nil)
+		req.Header.Set("Range", "bytes=2-4")
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, req))
+		return rec
+	}
+
+	// Filled as a whole.
+	rec := get()
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("0123456789", rec.Body.String())
+	assert.Equal(int32(2), atomic.LoadInt32(&requests))
+
+	meta, err := c.getFileMeta(chunkPath("example.org/bucket1/video.mp4", 0))
+	assert.NoError(err)
+	assert.Nil(meta)
+
+	// The ranges are served from the cached object from now on.
+	rec = get()
+	assert.Equal(http.StatusPartialContent, rec.Code)
+	assert.Equal("234", rec.Body.String())
+	assert.Equal(int32(2), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,282 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files younger than this are left alone by the reconciler, as they may
+// belong to a cache fill in progress.
+const reconcileGracePeriod = time.Minute
+
+type reconcileStats struct {
+	// Files on disk without metadata, including leftover temporary files.
+	orphanFiles int
+	orphanBytes int64
+
+	// Metadata without a file on disk.
+	missingFiles int
+
+	// Metadata with the wrong size.
+	resized int
+
+	emptyDirs int
+}
+
+func (s reconcileStats) String() string {
+	return fmt.Sprintf("removed %d orphan files (%d bytes), %d entries with missing files and %d empty directories, fixed %d sizes",
+		s.orphanFiles, s.orphanBytes, s.missingFiles, s.emptyDirs, s.resized)
+}
+
+// reconcile brings the metadata and the files on disk in line. It removes
+// files without metadata and empty directories, drops metadata without a
+// file, and fixes the sizes, then recounts the cache usage.
+func (c *cache) reconcile() (reconcileStats, error) {
+	var (
+		stats reconcileStats
+		known = make(map[string]bool)
+		now   = c.now()
+	)
+
+	// Collect first so we don't modify the stores while walking them.
+	var files []fileMeta
+	if err := c.walkAll(func(m fileMeta) bool {
+		files = append(files, m)
+		return true
+	}); err != nil {
+		return stats, err
+	}
+
+	for _, m := range files {
+		filename := c.osFilename(m.Filename)
+
+		fi, err := os.Stat(filename)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return stats, err
+			}
+			if _, err := c.metaFor(m.Filename).delete(m.Filename); err != nil {
+				return stats, err
+			}
+			stats.missingFiles++
+			continue
+		}
+
+		known[filename] = true
+
+		if fi.Size() != m.Size {
+			m.Size = fi.Size()
+			if err := c.metaFor(m.Filename).put(&m); err != nil {
+				return stats, err
+			}
+			stats.resized++
+		}
+	}
+
+	for _, root := range c.cacheRoots() {
+		if err := c.reconcileDir(root, known, now, &stats); err != nil {
+			return stats, err
+		}
+	}
+
+	if err := c.recountUsage(); err != nil {
+		return stats, err
+	}
+
+	c.logger.Info("area", "cache", "tag", "reconcile",
+		"orphan_files", stats.orphanFiles, "orphan_bytes", stats.orphanBytes,
+		"missing_files", stats.missingFiles, "resized", stats.resized,
+		"empty_dirs", stats.emptyDirs)
+
+	return stats, nil
+}
+
+// reconcileDir removes the files below root not in known and the empty
+// directories left behind.
+func (c *cache) reconcileDir(root string, known map[string]bool, now time.Time, stats *reconcileStats) error {
+	var (
+		dirs []string
+
+		// Fills started after this retry if their directory goes away,
+		// see createTempFile, and their temporary files are too new to
+		// be removed.
+		filling, fillingDirs = c.inFlight()
+	)
+
+	err := filepath.Walk(root, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if c.isReserved(filename) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if fi.IsDir() {
+			if filename != root {
+				dirs = append(dirs, filename)
+			}
+			return nil
+		}
+
+		if known[filename] || now.Sub(fi.ModTime()) < reconcileGracePeriod {
+			return nil
+		}
+
+		if target, ok := tempFileTarget(filename); ok && filling[target] {
+			// A slow fill.
+			return nil
+		}
+
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		stats.orphanFiles++
+		stats.orphanBytes += fi.Size()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deepest first, so parents of empty directories can go too.
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+
+	for _, dir := range dirs {
+		if fillingDirs[dir] {
+			continue
+		}
+		empty, err := isEmptyDir(dir)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			continue
+		}
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		stats.emptyDirs++
+	}
+
+	return nil
+}
+
+// inFlight returns the files being filled and the directories they go in.
+func (c *cache) inFlight() (files, dirs map[string]bool) {
+	files = make(map[string]bool)
+	dirs = make(map[string]bool)
+
+	for _, key := range c.fills.keys() {
+		filename := c.osFilename(key)
+		files[filename] = true
+		for dir := filepath.Dir(filename); !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	return files, dirs
+}
+
+// cacheRoots returns the directories holding the cached files, without
+// the ones inside another.
+func (c *cache) cacheRoots() []string {
+	dirs := []string{filepath.Clean(c.cfg.CacheDir)}
+	for _, p := range c.hosts {
+		dirs = append(dirs, filepath.Clean(p.dir))
+	}
+
+	sort.Strings(dirs)
+
+	var roots []string
+	for _, dir := range dirs {
+		if len(roots) > 0 && isWithin(roots[len(roots)-1], dir) {
+			continue
+		}
+		roots = append(roots, dir)
+	}
+
+	return roots
+}
+
+// isReserved reports whether filename is something other than a cached
+// file that may live in the cache directory, e.g. the metadata database.
+func (c *cache) isReserved(filename string) bool {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		// Leave it alone when in doubt.
+		return true
+	}
+
+	if c.cfg.DBFilename != "" {
+		db, err := filepath.Abs(c.cfg.DBFilename)
+		if err != nil {
+			return true
+		}
+		// The database may have companion files, e.g. SQLite's -wal.
+		for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+			if filename == db+suffix {
+				return true
+			}
+		}
+	}
+
+	if c.cfg.TLSCertsDir != "" {
+		certs, err := filepath.Abs(c.cfg.TLSCertsDir)
+		if err != nil || isWithin(certs, filename) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isWithin reports whether path is dir or inside it.
+func isWithin(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+
+	return false, err
+}
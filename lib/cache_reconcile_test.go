@@ -0,0 +1,223 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheReconcile(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects: map[string]string{
+			"/a.html": "aaaaaaaaaa",
+			"/b.html": "bbbbbbbbbb",
+			"/c.html": "cccccccccc",
+		},
+	}
+
+	c, clean := newTestCacheWithConfig(t, s3, func(cfg *Config) {
+		// Make sure we leave the database alone.
+		cfg.DBFilename = filepath.Join(cfg.CacheDir, "s3p.db")
+	})
+	defer clean()
+
+	for p := range s3.objects {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org"+p, nil)))
+		assert.Equal(http.StatusOK, rec.Code)
+	}
+
+	var (
+		dir  = filepath.Join(c.cfg.CacheDir, "example.org", "bucket1")
+		long = time.Now().Add(-time.Hour)
+	)
+
+	writeFile := func(filename string, old bool) {
+		assert.NoError(os.MkdirAll(filepath.Dir(filename), 0755))
+		assert.NoError(ioutil.WriteFile(filename, []byte("orphan"), 0644))
+		if old {
+			assert.NoError(os.Chtimes(filename, long, long))
+		}
+	}
+
+	assert.NoError(os.Remove(filepath.Join(dir, "b.html")))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "c.html"), []byte("c"), 0644))
+	writeFile(filepath.Join(dir, "orphan.html"), true)
+	writeFile(filepath.Join(dir, ".a.html.tmp123"), true)
+	writeFile(filepath.Join(dir, "sub", "orphan.html"), true)
+	writeFile(filepath.Join(dir, "new.html"), false)
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "empty", "dir"), 0755))
+
+	stats, err := c.reconcile()
+	assert.NoError(err)
+	assert.Equal(reconcileStats{
+		orphanFiles: 3, orphanBytes: 18, missingFiles: 1, resized: 1, emptyDirs: 3,
+	}, stats)
+
+	exists := func(filename string) bool {
+		_, err := os.Stat(filename)
+		return err == nil
+	}
+
+	assert.True(exists(c.cfg.DBFilename))
+	assert.True(exists(filepath.Join(dir, "a.html")))
+	assert.True(exists(filepath.Join(dir, "new.html")))
+	assert.False(exists(filepath.Join(dir, "sub")))
+	assert.False(exists(filepath.Join(dir, "empty")))
+
+	meta, err := c.getFileMeta("example.org/bucket1/b.html")
+	assert.NoError(err)
+	assert.Nil(meta)
+
+	meta, err = c.getFileMeta("example.org/bucket1/c.html")
+	assert.NoError(err)
+	assert.Equal(int64(1), meta.Size)
+
+	size, files := c.usage.get()
+	assert.Equal(int64(11), size)
+	assert.Equal(int64(2), files)
+
+	// Nothing more to do.
+	stats, err = c.reconcile()
+	assert.NoError(err)
+	assert.Equal(reconcileStats{}, stats)
+}
+
+func TestCacheReconcileDuringFill(t *testing.T) {
+	assert := require.New(t)
+
+	content := strings.Repeat("0123456789abcdef", 1<<12)
+
+	s3 := &fakeS3{
+		objects:  map[string]string{"/a/b/video.mp4": content},
+		bodyGate: make(chan struct{}),
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	var (
+		rec  = newFirstWriteRecorder()
+		errs = make(chan error, 1)
+		dir  = filepath.Join(c.cfg.CacheDir, "example.org", "bucket1", "a", "b")
+	)
+
+	go func() {
+		errs <- c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/a/b/video.mp4", nil))
+	}()
+
+	select {
+	case <-rec.first:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fill did not start")
+	}
+
+	// A fill slower than the grace period.
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, ".video.mp4.tmp*"))
+	assert.NoError(err)
+	assert.Len(tmpFiles, 1)
+	long := time.Now().Add(-time.Hour)
+	assert.NoError(os.Chtimes(tmpFiles[0], long, long))
+
+	stats, err := c.reconcile()
+	assert.NoError(err)
+	assert.Equal(reconcileStats{}, stats)
+
+	close(s3.bodyGate)
+	assert.NoError(<-errs)
+	assert.Equal(content, rec.Body.String())
+
+	meta, err := c.getFileMeta("example.org/bucket1/a/b/video.mp4")
+	assert.NoError(err)
+	assert.NotNil(meta)
+	_, err = os.Stat(filepath.Join(dir, "video.mp4"))
+	assert.NoError(err)
+}
+
+func TestTempFileTarget(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "s3p")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "a", "index.html")
+	f, err := createTempFile(filename)
+	assert.NoError(err)
+	f.Close()
+
+	target, ok := tempFileTarget(f.Name())
+	assert.True(ok)
+	assert.Equal(filename, target)
+
+	_, ok = tempFileTarget(filename)
+	assert.False(ok)
+	_, ok = tempFileTarget(filepath.Join(dir, ".tmp"))
+	assert.False(ok)
+}
+
+func TestCacheRoots(t *testing.T) {
+	assert := require.New(t)
+
+	c, clean := newTestCacheWithConfig(t, &fakeS3{}, func(cfg *Config) {
+		cfg.Hosts["a"] = Host{Name: "a", CacheDir: "a"}
+		cfg.Hosts["b"] = Host{Name: "b", CacheDir: "/var/cache/b"}
+	})
+	defer clean()
+
+	assert.ElementsMatch([]string{c.cfg.CacheDir, "/var/cache/b"}, c.cacheRoots())
+}
+
+func TestCacheIsReserved(t *testing.T) {
+	assert := require.New(t)
+
+	wd, err := os.Getwd()
+	assert.NoError(err)
+
+	c := &cache{cfg: Config{
+		CacheDir:    filepath.Join(wd, "cache"),
+		DBFilename:  filepath.Join("cache", "db"),
+		TLSCertsDir: filepath.Join(wd, "cache", "certs"),
+	}}
+
+	for _, test := range []struct {
+		filename string
+		expect   bool
+	}{
+		{filepath.Join(wd, "cache", "db"), true},
+		{filepath.Join(wd, "cache", "db-wal"), true},
+		{filepath.Join(wd, "cache", "db-shm"), true},
+		{filepath.Join("cache", "db"), true},
+		{filepath.Join(wd, "cache", "dbx"), false},
+		{filepath.Join(wd, "cache", "db", "index.html"), false},
+		{filepath.Join(wd, "cache", "certs"), true},
+		{filepath.Join("cache", "certs", "example.org"), true},
+		{filepath.Join(wd, "cache", "certsx", "index.html"), false},
+		{filepath.Join(wd, "cache", "index.html"), false},
+	} {
+		assert.Equal(test.expect, c.isReserved(test.filename), test.filename)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"net/http"
+	"strings"
+)
+
+const defaultSurrogateKeyHeader = "X-Amz-Meta-Surrogate-Key"
+
+func (c Config) surrogateKeyHeader() string {
+	if c.SurrogateKeyHeader == "" {
+		return defaultSurrogateKeyHeader
+	}
+	return c.SurrogateKeyHeader
+}
+
+// setTags moves the surrogate keys, if any, from the object's headers to
+// its tags.
+func (c *cache) setTags(meta *fileMeta) {
+	key := http.CanonicalHeaderKey(c.cfg.surrogateKeyHeader())
+
+	v, found := meta.Header[key]
+	if !found {
+		return
+	}
+
+	delete(meta.Header, key)
+	meta.Tags = parseTags(strings.Join(v, " "))
+}
+
+// parseTags parses a list of tags separated by spaces or commas.
+func parseTags(s string) []string {
+	var (
+		tags []string
+		seen = make(map[string]bool)
+	)
+
+	for _, tag := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+func (m fileMeta) hasAnyTag(tags map[string]bool) bool {
+	for _, tag := range m.Tags {
+		if tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeTags removes the cached objects below prefix that carry any of the
+// given tags, and returns how many were removed.
+func (c *cache) purgeTags(prefix string, tags []string) (int, error) {
+	files, err := c.metaFor(prefix).withPrefix(prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	set := make(map[string]bool)
+	for _, tag := range tags {
+		set[tag] = true
+	}
+
+	count := 0
+
+	for _, file := range files {
+		if !file.hasAnyTag(set) {
+			continue
+		}
+		if err := c.removeFile(file); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	c.logger.Info("area", "cache", "tag", "purge", "prefix", prefix, "tags", strings.Join(tags, ","), "count", count)
+
+	return count, nil
+}
@@ -0,0 +1,91 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTags(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Nil(parseTags(""))
+	assert.Equal([]string{"a", "b", "c"}, parseTags("a b,c , a"))
+}
+
+func TestCachePurgeTags(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects: map[string]string{
+			"/a.html":      "a",
+			"/b.html":      "b",
+			"/c.html":      "c",
+			"/blog/d.html": "d",
+		},
+		headers: map[string]http.Header{
+			"/a.html":      {"X-Amz-Meta-Surrogate-Key": {"header footer"}},
+			"/b.html":      {"X-Amz-Meta-Surrogate-Key": {"footer"}},
+			"/blog/d.html": {"X-Amz-Meta-Surrogate-Key": {"header"}},
+		},
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	get := func(p string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org"+p, nil)))
+		return rec
+	}
+
+	for _, p := range []string{"/a.html", "/b.html", "/c.html", "/blog/d.html"} {
+		rec := get(p)
+		assert.Equal(http.StatusOK, rec.Code)
+		// The tags are ours.
+		assert.Empty(rec.Header().Get("X-Amz-Meta-Surrogate-Key"))
+	}
+
+	meta, err := c.getFileMeta("example.org/bucket1/a.html")
+	assert.NoError(err)
+	assert.Equal([]string{"header", "footer"}, meta.Tags)
+
+	cached := func(p string) bool {
+		meta, err := c.getFileMeta("example.org/bucket1" + p)
+		assert.NoError(err)
+		return meta != nil
+	}
+
+	host, _ := c.cfg.host("example.org")
+
+	count, err := c.purgeTags(host.purgePrefix("blog/"), []string{"header"})
+	assert.NoError(err)
+	assert.Equal(1, count)
+	assert.True(cached("/a.html"))
+	assert.False(cached("/blog/d.html"))
+
+	count, err = c.purgeTags(host.purgePrefix(""), []string{"footer", "missing"})
+	assert.NoError(err)
+	assert.Equal(2, count)
+	assert.False(cached("/a.html"))
+	assert.False(cached("/b.html"))
+	assert.True(cached("/c.html"))
+
+	assert.Equal("a", get("/a.html").Body.String())
+}
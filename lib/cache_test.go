@@ -0,0 +1,986 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a http.RoundTripper that answers all requests with the
+// configured objects and counts the requests made.
+type fakeS3 struct {
+	objects map[string]string
+
+	// If set, requests will block until this is closed.
+	release chan struct{}
+
+	// If set, the response body will fail halfway through.
+	failBody bool
+
+	// Optional Cache-Control header sent with every object.
+	cacheControl string
+
+	// If set, all requests will fail with this status code.
+	failStatus int
+
+	// If set, sent instead of the MD5 of the content.
+	etag string
+
+	// Extra headers sent with the object at the given path.
+	headers map[string]http.Header
+
+	// If set, the second half of the response body is held back until
+	// this is closed.
+	bodyGate chan struct{}
+
+	requests int32
+	heads    int32
+
+	// The Range headers received, in order.
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (s *fakeS3) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&s.requests, 1)
+	if req.Method == "HEAD" {
+		atomic.AddInt32(&s.heads, 1)
+	}
+
+	if s.release != nil {
+		<-s.release
+	}
+
+	rec := httptest.NewRecorder()
+	content, found := s.objects[req.URL.Path]
+	if s.failStatus != 0 {
+		rec.WriteHeader(s.failStatus)
+	} else if !found {
+		rec.WriteHeader(http.StatusNotFound)
+	} else {
+		etag := fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum([]byte(content))))
+		if s.etag != "" {
+			etag = s.etag
+		}
+		rec.Header().Set("Etag", etag)
+		rec.Header().Set("Last-Modified", fakeLastModified)
+		for k, v := range s.headers[req.URL.Path] {
+			rec.Header()[k] = v
+		}
+		if s.cacheControl != "" {
+			rec.Header().Set("Cache-Control", s.cacheControl)
+		}
+		r, hasRange := parseRange(req.Header.Get("Range"))
+		if hasRange {
+			s.mu.Lock()
+			s.ranges = append(s.ranges, r.String())
+			s.mu.Unlock()
+		}
+		if req.Header.Get("If-None-Match") == etag {
+			rec.WriteHeader(http.StatusNotModified)
+		} else if hasRange {
+			if im := req.Header.Get("If-Match"); im != "" && im != etag {
+				rec.WriteHeader(http.StatusPreconditionFailed)
+			} else if start, end, ok := r.resolve(int64(len(content))); !ok {
+				rec.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(content)))
+				rec.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			} else {
+				content = content[start : end+1]
+				rec.Header().Set("Content-Type", "text/html")
+				rec.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(s.objects[req.URL.Path])))
+				rec.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				rec.WriteHeader(http.StatusPartialContent)
+				rec.WriteString(content)
+			}
+		} else {
+			rec.Header().Set("Content-Type", "text/html")
+			rec.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			rec.WriteString(content)
+		}
+	}
+
+	resp := rec.Result()
+	resp.ContentLength = int64(rec.Body.Len())
+	resp.Request = req
+
+	if req.Method == "HEAD" {
+		resp.Body = ioutil.NopCloser(strings.NewReader(""))
+		return resp, nil
+	}
+
+	if s.failBody {
+		resp.Body = ioutil.NopCloser(io.MultiReader(
+			strings.NewReader(content[:len(content)/2]),
+			errReader{}))
+	} else if s.bodyGate != nil {
+		resp.Body = ioutil.NopCloser(io.MultiReader(
+			strings.NewReader(content[:len(content)/2]),
+			gateReader{gate: s.bodyGate, r: strings.NewReader(content[len(content)/2:])}))
+	}
+
+	return resp, nil
+}
+
+const fakeLastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type gateReader struct {
+	gate chan struct{}
+	r    io.Reader
+}
+
+func (g gateReader) Read(p []byte) (int, error) {
+	<-g.gate
+	return g.r.Read(p)
+}
+
+// firstWriteRecorder is a http.ResponseWriter that tells when the first
+// bytes of the body arrive.
+type firstWriteRecorder struct {
+	*httptest.ResponseRecorder
+	mu    sync.Mutex
+	first chan struct{}
+}
+
+func newFirstWriteRecorder() *firstWriteRecorder {
+	return &firstWriteRecorder{ResponseRecorder: httptest.NewRecorder(), first: make(chan struct{})}
+}
+
+func (w *firstWriteRecorder) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ResponseRecorder.Body.Len() == 0 && len(p) > 0 {
+		close(w.first)
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+// brokenRecorder is a firstWriteRecorder that fails all writes once
+// broken, like a client that has gone away.
+type brokenRecorder struct {
+	*firstWriteRecorder
+	broken int32
+}
+
+func (w *brokenRecorder) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&w.broken) == 1 {
+		return 0, errors.New("broken pipe")
+	}
+	return w.firstWriteRecorder.Write(p)
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func newTestCache(t testing.TB, s3 *fakeS3) (*cache, func()) {
+	return newTestCacheWithConfig(t, s3, nil)
+}
+
+// newTestCacheWithConfig creates a test cache with the example.org host.
+// Use configure to adjust the config, e.g. to add more hosts.
+func newTestCacheWithConfig(t testing.TB, s3 *fakeS3, configure func(cfg *Config)) (*cache, func()) {
+	dir, err := ioutil.TempDir("", "s3p")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		CacheDir:   filepath.Join(dir, "cache"),
+		DBFilename: filepath.Join(dir, "s3p.db"),
+		Hosts: map[string]Host{
+			"example.org": {Name: "example.org", Bucket: "bucket1", AccessKey: "ak", SecretKey: "sk"},
+		},
+	}
+
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	logger := NewLogger(log.NewNopLogger())
+
+	c, err := newCache(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range cfg.Hosts {
+		c.origins[host.Name] = s3Client{
+			host:   host,
+			creds:  newCredentialsChain(cfg, host),
+			logger: logger,
+			client: &http.Client{Transport: s3},
+		}
+	}
+
+	return c, func() {
+		c.close()
+		os.RemoveAll(dir)
+	}
+}
+
+// waitForWaiters waits until n requests are waiting for the fill for key.
+func waitForWaiters(t testing.TB, g *fillGroup, key string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for g.waiting(key) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d waiters for %q, got %d", n, key, g.waiting(key))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFillGroup(t *testing.T) {
+	assert := require.New(t)
+
+	type result struct {
+		meta   *fileMeta
+		shared bool
+		err    error
+	}
+
+	var (
+		g       = newFillGroup()
+		calls   int32
+		started = make(chan struct{})
+		release = make(chan struct{})
+		results = make(chan result, 11)
+		wg      sync.WaitGroup
+	)
+
+	fn := func(*fill) (*fileMeta, error) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return &fileMeta{Filename: "a"}, nil
+	}
+
+	do := func() {
+		defer wg.Done()
+		meta, shared, err := g.do("a", fn, nil)
+		results <- result{meta: meta, shared: shared, err: err}
+	}
+
+	wg.Add(1)
+	go do()
+
+	<-started
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go do()
+	}
+
+	waitForWaiters(t, g, "a", 10)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	var sharedCount int
+	for r := range results {
+		assert.NoError(r.err)
+		assert.Equal("a", r.meta.Filename)
+		if r.shared {
+			sharedCount++
+		}
+	}
+
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(10, sharedCount)
+	assert.Len(g.fills, 0)
+}
+
+func TestCacheCoalesceFills(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects: map[string]string{"/index.html": "<h1>Hugo</h1>"},
+		release: make(chan struct{}),
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	var (
+		wg        sync.WaitGroup
+		recorders = make([]*httptest.ResponseRecorder, 20)
+		errs      = make(chan error, len(recorders))
+	)
+
+	for i := 0; i < len(recorders); i++ {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "http://example.org/", nil)
+			errs <- c.handleRequest(rec, req)
+		}(recorders[i])
+	}
+
+	// Let the requests pile up behind the first fill.
+	waitForWaiters(t, c.fills, "example.org/bucket1/index.html", len(recorders)-1)
+	close(s3.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(err)
+	}
+
+	assert.Equal(int32(1), atomic.LoadInt32(&s3.requests))
+
+	for _, rec := range recorders {
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal("<h1>Hugo</h1>", rec.Body.String())
+	}
+
+	// A later request should be served from the cache.
+	rec := httptest.NewRecorder()
+	assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil)))
+	assert.True(strings.Contains(rec.Body.String(), "Hugo"))
+	assert.Equal(int32(1), atomic.LoadInt32(&s3.requests))
+}
+
+func TestCacheStreamFillToFollowers(t *testing.T) {
+	assert := require.New(t)
+
+	content := strings.Repeat("0123456789abcdef", 1<<12)
+
+	s3 := &fakeS3{
+		objects:  map[string]string{"/video.mp4": content},
+		bodyGate: make(chan struct{}),
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	var (
+		wg        sync.WaitGroup
+		recorders = []*firstWriteRecorder{newFirstWriteRecorder(), newFirstWriteRecorder(), newFirstWriteRecorder()}
+		errs      = make(chan error, len(recorders))
+	)
+
+	get := func(rec *firstWriteRecorder) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/video.mp4", nil))
+		}()
+	}
+
+	waitFirst := func(rec *firstWriteRecorder) {
+		select {
+		case <-rec.first:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no bytes received while the fill is in progress")
+		}
+	}
+
+	get(recorders[0])
+	waitFirst(recorders[0])
+
+	// The followers get the first half while the second is still held back.
+	get(recorders[1])
+	get(recorders[2])
+	waitFirst(recorders[1])
+	waitFirst(recorders[2])
+
+	close(s3.bodyGate)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(err)
+	}
+
+	assert.Equal(int32(1), atomic.LoadInt32(&s3.requests))
+
+	for _, rec := range recorders {
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal("text/html", rec.Header().Get("Content-Type"))
+		assert.Equal(content, rec.Body.String())
+	}
+}
+
+func TestCacheStreamFillWhenLeaderGoesAway(t *testing.T) {
+	assert := require.New(t)
+
+	content := strings.Repeat("0123456789abcdef", 1<<12)
+
+	s3 := &fakeS3{
+		objects:  map[string]string{"/video.mp4": content},
+		bodyGate: make(chan struct{}),
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	var (
+		wg       sync.WaitGroup
+		leader   = &brokenRecorder{firstWriteRecorder: newFirstWriteRecorder()}
+		follower = newFirstWriteRecorder()
+		errs     = make(chan error, 2)
+	)
+
+	get := func(rec http.ResponseWriter, first chan struct{}) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/video.mp4", nil))
+		}()
+
+		select {
+		case <-first:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no bytes received while the fill is in progress")
+		}
+	}
+
+	get(leader, leader.first)
+	get(follower, follower.first)
+
+	// The leader goes away halfway through.
+	atomic.StoreInt32(&leader.broken, 1)
+	close(s3.bodyGate)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(err)
+	}
+
+	assert.Equal(http.StatusOK, follower.Code)
+	assert.Equal(content, follower.Body.String())
+	assert.Equal(len(content)/2, leader.Body.Len())
+
+	meta, err := c.getFileMeta("example.org/bucket1/video.mp4")
+	assert.NoError(err)
+	assert.NotNil(meta)
+	assert.Equal(int64(len(content)), meta.Size)
+
+	// Served from the cache from now on.
+	rec := httptest.NewRecorder()
+	assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/video.mp4", nil)))
+	assert.Equal(content, rec.Body.String())
+	assert.Equal(int32(1), atomic.LoadInt32(&s3.requests))
+}
+
+func TestCacheFailedFillIsNotStored(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects:  map[string]string{"/index.html": "<h1>Hugo</h1>"},
+		failBody: true,
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	req := httptest.NewRequest("GET", "http://example.org/", nil)
+	assert.Error(c.handleRequest(httptest.NewRecorder(), req))
+
+	meta, err := c.getFileMeta("example.org/bucket1/index.html")
+	assert.NoError(err)
+	assert.Nil(meta)
+
+	var files []string
+	filepath.Walk(c.cfg.CacheDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	assert.Len(files, 0)
+
+	// Next attempt succeeds.
+	s3.failBody = false
+	rec := httptest.NewRecorder()
+	assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil)))
+
+	meta, err = c.getFileMeta("example.org/bucket1/index.html")
+	assert.NoError(err)
+	assert.NotNil(meta)
+	assert.Equal(int64(len("<h1>Hugo</h1>")), meta.Size)
+
+	b, err := ioutil.ReadFile(filepath.Join(c.cfg.CacheDir, "example.org/bucket1/index.html"))
+	assert.NoError(err)
+	assert.Equal("<h1>Hugo</h1>", string(b))
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects:      map[string]string{"/index.html": "v1"},
+		cacheControl: "max-age=60",
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil)))
+		assert.Equal(http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	assert.Equal("v1", get())
+	assert.Equal("v1", get())
+	assert.Equal(int32(1), s3.requests)
+
+	// Stale, but not modified.
+	now = now.Add(2 * time.Minute)
+	assert.Equal("v1", get())
+	assert.Equal(int32(2), s3.requests)
+
+	meta, err := c.getFileMeta("example.org/bucket1/index.html")
+	assert.NoError(err)
+	assert.Equal(now.Add(time.Minute).Unix(), meta.Expires.Unix())
+
+	assert.Equal("v1", get())
+	assert.Equal(int32(2), s3.requests)
+
+	// Stale and modified.
+	s3.objects["/index.html"] = "v2"
+	now = now.Add(2 * time.Minute)
+	assert.Equal("v2", get())
+	assert.Equal("v2", get())
+	assert.Equal(int32(3), s3.requests)
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects:      map[string]string{"/index.html": "v1"},
+		cacheControl: "max-age=60",
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	host := c.cfg.Hosts["example.org"]
+	host.StaleWhileRevalidate = duration{time.Minute}
+	c.cfg.Hosts["example.org"] = host
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil)))
+		assert.Equal(http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	assert.Equal("v1", get())
+
+	s3.objects["/index.html"] = "v2"
+	now = now.Add(90 * time.Second)
+
+	// Stale, served while refreshed in the background.
+	assert.Equal("v1", get())
+
+	for i := 0; i < 100; i++ {
+		if meta, _ := c.getFileMeta("example.org/bucket1/index.html"); meta != nil && !meta.isStale(now) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal("v2", get())
+	assert.Equal(int32(2), atomic.LoadInt32(&s3.requests))
+
+	// Outside of the window we have to wait for S3.
+	s3.objects["/index.html"] = "v3"
+	now = now.Add(5 * time.Minute)
+	assert.Equal("v3", get())
+}
+
+func TestCacheCloseWaitsForRevalidation(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects:      map[string]string{"/index.html": "v1"},
+		cacheControl: "max-age=60",
+	}
+
+	c, _ := newTestCacheWithConfig(t, s3, func(cfg *Config) {
+		host := cfg.Hosts["example.org"]
+		host.StaleWhileRevalidate = duration{time.Minute}
+		cfg.Hosts["example.org"] = host
+	})
+	defer os.RemoveAll(filepath.Dir(c.cfg.CacheDir))
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	get := func() {
+		assert.NoError(c.handleRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.org/", nil)))
+	}
+
+	get()
+
+	// The revalidation blocks in the origin.
+	s3.release = make(chan struct{})
+	now = now.Add(90 * time.Second)
+	get()
+
+	closed := make(chan error)
+	go func() {
+		closed <- c.close()
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("closed while revalidating")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(s3.release)
+	assert.NoError(<-closed)
+
+	// No new background work once closed.
+	c.background(func() {
+		t.Error("background work started after close")
+	})
+	c.wg.Wait()
+	assert.Equal(int32(2), atomic.LoadInt32(&s3.requests))
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects:      map[string]string{"/index.html": "v1"},
+		cacheControl: "max-age=60",
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	host := c.cfg.Hosts["example.org"]
+	host.StaleIfError = duration{time.Hour}
+	c.cfg.Hosts["example.org"] = host
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	get := func() (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		err := c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil))
+		return rec, err
+	}
+
+	_, err := get()
+	assert.NoError(err)
+
+	s3.failStatus = http.StatusServiceUnavailable
+	now = now.Add(30 * time.Minute)
+
+	rec, err := get()
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("v1", rec.Body.String())
+	assert.Equal(int32(2), s3.requests)
+
+	// Too old.
+	now = now.Add(2 * time.Hour)
+	_, err = get()
+	assert.Error(err)
+}
+
+func TestCacheServeStaleWhenCircuitOpen(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects:      map[string]string{"/index.html": "v1"},
+		cacheControl: "max-age=60",
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	origin := c.origins["example.org"].(s3Client)
+	origin.client.Transport = &breakerTransport{
+		next:    s3,
+		breaker: newBreaker("example.org", 1, time.Hour, c.logger),
+	}
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	get := func() (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		err := c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil))
+		return rec, err
+	}
+
+	_, err := get()
+	assert.NoError(err)
+
+	s3.failStatus = http.StatusInternalServerError
+	now = now.Add(24 * time.Hour)
+
+	// No stale-if-error configured, but the breaker opens.
+	_, err = get()
+	assert.Error(err)
+
+	rec, err := get()
+	assert.NoError(err)
+	assert.Equal("v1", rec.Body.String())
+	assert.Equal(int32(2), s3.requests)
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	s3 := &fakeS3{objects: map[string]string{"/index.html": "<h1>Hugo</h1>"}}
+
+	c, clean := newTestCache(b, s3)
+	defer clean()
+
+	if err := c.handleRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.org/", nil)); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rec := httptest.NewRecorder()
+			if err := c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil)); err != nil {
+				b.Fatal(err)
+			}
+			if rec.Code != http.StatusOK {
+				b.Fatalf("got %d", rec.Code)
+			}
+		}
+	})
+}
+
+func TestCacheHeadAndConditionalGet(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects:      map[string]string{"/index.html": "v1"},
+		headers:      map[string]http.Header{"/index.html": {"X-Amz-Meta-Surrogate-Key": {"home"}}},
+		cacheControl: "max-age=60",
+	}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	do := func(method string, h http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.org/", nil)
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, req))
+		return rec
+	}
+
+	// A HEAD miss asks the origin for the headers only and caches nothing.
+	rec := do("HEAD", nil)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("2", rec.Header().Get("Content-Length"))
+	assert.Equal(fakeLastModified, rec.Header().Get("Last-Modified"))
+	assert.Empty(rec.Header().Get("X-Amz-Meta-Surrogate-Key"))
+	assert.Empty(rec.Body.String())
+	assert.Equal(int32(1), s3.heads)
+	meta, err := c.getFileMeta("example.org/bucket1/index.html")
+	assert.NoError(err)
+	assert.Nil(meta)
+
+	rec = do("GET", nil)
+	assert.Equal("v1", rec.Body.String())
+	etag := rec.Header().Get("Etag")
+	assert.NotEmpty(etag)
+
+	meta, err = c.getFileMeta("example.org/bucket1/index.html")
+	assert.NoError(err)
+	modTime, _ := http.ParseTime(fakeLastModified)
+	assert.True(modTime.Equal(meta.ModTime))
+
+	// Cached from now on.
+	rec = do("HEAD", nil)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(fakeLastModified, rec.Header().Get("Last-Modified"))
+	assert.Equal(int32(1), s3.heads)
+
+	rec = do("GET", http.Header{"If-None-Match": {etag}})
+	assert.Equal(http.StatusNotModified, rec.Code)
+	assert.Empty(rec.Body.String())
+
+	rec = do("GET", http.Header{"If-Modified-Since": {fakeLastModified}})
+	assert.Equal(http.StatusNotModified, rec.Code)
+
+	assert.Equal(int32(2), s3.requests)
+}
+
+func TestCacheNegativeCaching(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{objects: map[string]string{}}
+
+	c, clean := newTestCacheWithConfig(t, s3, func(cfg *Config) {
+		host := cfg.Hosts["example.org"]
+		host.NegativeTTL = duration{10 * time.Second}
+		host.StaleWhileRevalidate = duration{time.Hour}
+		cfg.Hosts["example.org"] = host
+	})
+	defer clean()
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	doPath := func(method, p string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest(method, "http://example.org"+p, nil)))
+		return rec
+	}
+
+	do := func(method string) *httptest.ResponseRecorder {
+		return doPath(method, "/new.html")
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := do("GET")
+		assert.Equal(http.StatusNotFound, rec.Code)
+		assert.Equal("Not Found", rec.Body.String())
+		assert.Equal("text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	}
+	assert.Equal(int32(1), s3.requests)
+
+	rec := do("HEAD")
+	assert.Equal(http.StatusNotFound, rec.Code)
+	assert.Empty(rec.Body.String())
+	assert.Equal(int32(1), s3.requests)
+
+	// Deployed, but the 404 is still fresh.
+	s3.objects["/new.html"] = "new"
+	assert.Equal(http.StatusNotFound, do("GET").Code)
+
+	// Expired. The stale 404 is not served while revalidating.
+	now = now.Add(11 * time.Second)
+	rec = do("GET")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("new", rec.Body.String())
+	assert.Equal(int32(2), s3.requests)
+
+	// Purged.
+	assert.Equal(http.StatusNotFound, doPath("GET", "/other.html").Code)
+	s3.objects["/other.html"] = "other"
+	_, err := c.purgePrefix("example.org/")
+	assert.NoError(err)
+	rec = doPath("GET", "/other.html")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("other", rec.Body.String())
+}
+
+func TestCacheNoStore(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{
+		objects:      map[string]string{"/index.html": "<h1>Hugo</h1>", "/video.mp4": "0123456789abcdefghij"},
+		headers:      map[string]http.Header{"/index.html": {"X-Amz-Meta-Surrogate-Key": {"home"}}},
+		cacheControl: "max-age=60",
+	}
+
+	c, clean := newTestCacheWithConfig(t, s3, func(cfg *Config) {
+		cfg.ChunkSize = 8
+	})
+	defer clean()
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	get := func(p, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.org"+p, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, req))
+		return rec
+	}
+
+	cachedFiles := func() int {
+		var files int
+		filepath.Walk(c.cfg.CacheDir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files++
+			}
+			return nil
+		})
+		return files
+	}
+
+	assertNotCached := func(cacheControl string) {
+		rec := get("/", "")
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal("<h1>Hugo</h1>", rec.Body.String())
+		assert.Equal(cacheControl, rec.Header().Get("Cache-Control"))
+		assert.Empty(rec.Header().Get("X-Amz-Meta-Surrogate-Key"))
+
+		rec = get("/video.mp4", "bytes=10-12")
+		assert.Equal(http.StatusPartialContent, rec.Code)
+		assert.Equal("abc", rec.Body.String())
+
+		assert.Equal(0, cachedFiles())
+		meta, err := c.getFileMeta("example.org/bucket1/index.html")
+		assert.NoError(err)
+		assert.Nil(meta)
+	}
+
+	assert.Equal("<h1>Hugo</h1>", get("/", "").Body.String())
+	assert.Equal("01234567", get("/video.mp4", "bytes=0-7").Body.String())
+	assert.Equal(2, cachedFiles())
+
+	// The cached copies are dropped when they are revalidated.
+	s3.cacheControl = "no-store"
+	now = now.Add(time.Hour)
+	assertNotCached("no-store")
+
+	s3.cacheControl = "private, max-age=60"
+	requests := atomic.LoadInt32(&s3.requests)
+	assertNotCached("private, max-age=60")
+	assertNotCached("private, max-age=60")
+
+	// One request for the page and two for the range: the chunk we
+	// could not keep and the range passed on to the origin.
+	assert.Equal(requests+6, atomic.LoadInt32(&s3.requests))
+}
@@ -20,7 +20,9 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/go-kit/kit/log"
@@ -36,9 +38,56 @@ type Config struct {
 	// TLS will be enabled if set.
 	TLSCertsDir string
 
+	// Where to store the cache metadata: "bolt" (default), "memory"
+	// or "sqlite". The last needs a build with -tags sqlite.
+	MetaStore string
+
 	// Path and name of the metadata database.
 	DBFilename string
 
+	// Keep the cache below these limits. Zero means no limit. The size can
+	// have a unit, e.g. "512MB" or "10GB".
+	MaxCacheSize  byteSize
+	MaxCacheFiles int
+
+	// Start evicting when the cache reaches CacheHighWatermark (default 1.0)
+	// of the limits above and stop at CacheLowWatermark (default 0.9).
+	CacheHighWatermark float64
+	CacheLowWatermark  float64
+
+	// How often to check the cache limits, default 1m. They are also
+	// checked after every cache fill.
+	MaintenanceInterval duration
+
+	// Cache large objects in chunks of this size, e.g. "8MB", so range
+	// requests, e.g. when seeking in a video, only fetch the parts needed.
+	// Objects first requested with a Range header are cached this way.
+	// Zero, the default, disables this, and range requests for objects not
+	// in the cache are then passed on to the origin.
+	ChunkSize byteSize
+
+	// Keep up to MemoryCacheSize bytes of the most recently used objects
+	// in memory. Only objects up to MemoryCacheMaxObjectSize (default 1MB)
+	// are kept. Zero, the default, disables this.
+	MemoryCacheSize          byteSize
+	MemoryCacheMaxObjectSize byteSize
+
+	// Check the cached files against their MD5 checksum before serving
+	// them, and fetch them again from the origin if they don't match.
+	// This means reading every file twice.
+	VerifyChecksums bool
+
+	// Which cache entries to evict first when shrinking the cache: "lru"
+	// (default), the least recently used, or "lfu", the ones with the
+	// fewest hits per byte.
+	EvictionPolicy string
+
+	// The origin header with the surrogate keys, or tags, of an object,
+	// separated by spaces or commas. The objects with a given tag can be
+	// purged with /__s3p/purge?tag=. Default is "X-Amz-Meta-Surrogate-Key",
+	// the "surrogate-key" user metadata in S3.
+	SurrogateKeyHeader string
+
 	ServerAddr string
 
 	Hosts map[string]Host
@@ -46,6 +95,25 @@ type Config struct {
 	DefaultHostAccessKey string
 	DefaultHostSecretKey string
 	SecretKey            string
+
+	// The EC2 instance metadata service to get IAM role credentials from
+	// when none are found elsewhere. Default is http://169.254.169.254.
+	MetadataURL string
+
+	// Timeouts for requests to the origins. Defaults are 5s to connect,
+	// 30s to get the response headers and 10m for the full request.
+	OriginConnectTimeout        duration
+	OriginResponseHeaderTimeout duration
+	OriginTimeout               duration
+
+	// How many times to retry failed requests to the origins. Default is 2,
+	// set it to -1 to disable retries.
+	OriginRetries int
+
+	// Stop asking an origin for BreakerCooldown (default 30s) after
+	// BreakerThreshold (default 5) failed requests in a row.
+	BreakerThreshold int
+	BreakerCooldown  duration
 }
 
 type Host struct {
@@ -55,12 +123,169 @@ type Host struct {
 
 	AccessKey string
 	SecretKey string
+
+	// Only needed for temporary credentials.
+	SessionToken string
+
+	// The profile in the shared credentials file (~/.aws/credentials) to
+	// use when no keys are set above or in the AWS_* environment variables.
+	// Default is AWS_PROFILE or "default".
+	Profile string
+
+	// The AWS signature version to use, 4 (default) or 2. Version 2 is
+	// only supported in the older AWS regions and by some S3 compatible stores.
+	SignatureVersion int
+
+	// Where to fetch the objects from: "s3" (default), "http" or "dir".
+	Origin string
+
+	// Base URL for the "http" origin.
+	OriginURL string
+
+	// Root directory for the "dir" origin.
+	OriginDir string
+
+	// The S3 endpoint, e.g. "s3.eu-west-1.amazonaws.com" or
+	// "localhost:9000" for a MinIO server. Default is the AWS endpoint
+	// for Region.
+	Endpoint string
+
+	// The S3 region. Default is "us-east-1".
+	Region string
+
+	// Whether to use HTTPS when talking to S3. Default is true.
+	UseSSL *bool
+
+	// Use path-style (endpoint/bucket/key) instead of virtual-hosted
+	// (bucket.endpoint/key) addressing. This is always used for buckets
+	// with dots in their names over HTTPS.
+	PathStyle bool
+
+	// Limits for this host's share of the cache. These are enforced
+	// before the global limits, see Config.MaxCacheSize.
+	MaxCacheSize  byteSize
+	MaxCacheFiles int
+
+	// Store this host's files in this directory, relative to
+	// Config.CacheDir or absolute.
+	CacheDir string
+
+	// Keep this host's metadata in its own bucket in the metadata store.
+	// Hosts can share a bucket.
+	MetaBucket string
+
+	// Custom error pages keyed by status code, e.g. { "404" = "404.html" }.
+	// They are fetched from the origin and cached like any other object.
+	ErrorPages map[string]string
+
+	// Buckets to try, in order, when the one above fails.
+	Fallbacks []Fallback
+
+	// How long to cache objects without any Cache-Control or Expires
+	// header from the origin. Zero means until purged.
+	DefaultTTL duration
+
+	// Upper limit for how long any object is considered fresh.
+	// Zero means no limit.
+	MaxTTL duration
+
+	// For how long after it has expired a stale object can be served
+	// while it is refreshed in the background.
+	StaleWhileRevalidate duration
+
+	// For how long after it has expired a stale object can be served
+	// when the origin fails.
+	StaleIfError duration
+
+	// How long to cache a 404 from the origin, so a newly deployed page
+	// shows up soon. A shorter lifetime set by the origin wins.
+	// Default is 1 minute.
+	NegativeTTL duration
+}
+
+// Fallback is a replica of a host's bucket, e.g. in another region.
+// Region and Endpoint are not inherited from the host.
+type Fallback struct {
+	Bucket   string
+	Region   string
+	Endpoint string
+}
+
+// duration is a time.Duration that can be read from a string in TOML, e.g. "5m".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// byteSize is a size in bytes that can be read from a string in TOML with
+// an optional unit, e.g. "512MB". The units are powers of 1024.
+type byteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	v, err := parseByteSize(string(text))
+	*b = byteSize(v)
+	return err
+}
+
+func parseByteSize(in string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(in))
+	multiplier := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			multiplier = u.size
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", in)
+	}
+
+	return int64(v * float64(multiplier)), nil
 }
 
 func (h Host) hostPath(in string) string {
 	return path.Join(h.Name, h.Bucket, h.Path, in)
 }
 
+// purgePrefix returns the cache filename prefix for the given URL path prefix.
+// An empty prefix or one ending in a slash matches a full directory only.
+func (h Host) purgePrefix(prefix string) string {
+	p := h.hostPath(prefix)
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		p += "/"
+	}
+	return p
+}
+
+func (h Host) isS3Origin() bool {
+	o := strings.ToLower(h.Origin)
+	return o == "" || o == originS3
+}
+
+// errorPage returns the path of the error page for status, if any.
+func (h Host) errorPage(status int) string {
+	return h.ErrorPages[strconv.Itoa(status)]
+}
+
 func (h Host) bucketPath(in string) string {
 	return path.Join(h.Path, in)
 }
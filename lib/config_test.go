@@ -17,6 +17,7 @@ package lib
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -32,6 +33,8 @@ serverAddr = ":8080"
 defaultHostAccessKey = "yourHostSecretAccessKey"
 defaultHostSecretKey = "yourHostSecretKey"
 secretKey = "yourSecret"
+maxCacheSize = "10GB"
+maxCacheFiles = 1000
 
 [hosts]
 [hosts."example.org"]
@@ -39,15 +42,33 @@ bucket = "bucket1"
 path = "path1"
 accessKey = "ac1"
 secretKey = "as1"
+defaultTTL = "5m"
+maxTTL = "24h"
+maxCacheSize = "1GB"
+cacheDir = "org"
+metaBucket = "org"
+[[hosts."example.org".fallbacks]]
+bucket = "bucket1-eu"
+region = "eu-west-1"
+[[hosts."example.org".fallbacks]]
+bucket = "bucket1-minio"
+endpoint = "minio.example.org"
 [hosts."example.com"]
 bucket = "bucket2"
 path = "path2"
+endpoint = "localhost:9000"
+region = "eu-west-1"
+useSSL = false
+pathStyle = true
+signatureVersion = 2
 
 `
 	c, err := readConfig(strings.NewReader(basic))
 
 	assert.NoError(err)
 	assert.Equal("cache", c.CacheDir)
+	assert.Equal(byteSize(10<<30), c.MaxCacheSize)
+	assert.Equal(1000, c.MaxCacheFiles)
 	assert.Len(c.Hosts, 2)
 	assert.Equal([]string{"example.com", "example.org"}, c.hostNames())
 
@@ -56,12 +77,62 @@ path = "path2"
 	assert.Equal("ac1", h.AccessKey)
 	assert.Equal("as1", h.SecretKey)
 	assert.Equal("example.org", h.Name)
+	assert.Equal(5*time.Minute, h.DefaultTTL.Duration)
+	assert.Equal(24*time.Hour, h.MaxTTL.Duration)
+	assert.Equal(byteSize(1<<30), h.MaxCacheSize)
+	assert.Equal("org", h.CacheDir)
+	assert.Equal("org", h.MetaBucket)
+	assert.Equal([]Fallback{
+		{Bucket: "bucket1-eu", Region: "eu-west-1"},
+		{Bucket: "bucket1-minio", Endpoint: "minio.example.org"}}, h.Fallbacks)
 
 	h = c.Hosts["example.com"]
 
 	assert.Equal("yourHostSecretAccessKey", h.AccessKey)
 	assert.Equal("yourHostSecretKey", h.SecretKey)
+	assert.Equal("localhost:9000", h.Endpoint)
+	assert.Equal("eu-west-1", h.Region)
+	assert.False(*h.UseSSL)
+	assert.True(h.PathStyle)
+	assert.Equal(2, h.SignatureVersion)
+	assert.Nil(c.Hosts["example.org"].UseSSL)
 
 	// TODO(bep) env overrides
 
 }
+
+func TestHostPurgePrefix(t *testing.T) {
+	assert := require.New(t)
+
+	h := Host{Name: "example.org", Bucket: "b", Path: "p"}
+
+	assert.Equal("example.org/b/p/", h.purgePrefix(""))
+	assert.Equal("example.org/b/p/", h.purgePrefix("/"))
+	assert.Equal("example.org/b/p/blog/", h.purgePrefix("/blog/"))
+	assert.Equal("example.org/b/p/blog", h.purgePrefix("blog"))
+}
+
+func TestParseByteSize(t *testing.T) {
+	assert := require.New(t)
+
+	for _, test := range []struct {
+		in     string
+		expect int64
+	}{
+		{"123", 123},
+		{"10B", 10},
+		{"2KB", 2048},
+		{"1.5 MB", 3 << 19},
+		{"10gb", 10 << 30},
+		{"1TB", 1 << 40},
+	} {
+		v, err := parseByteSize(test.in)
+		assert.NoError(err, test.in)
+		assert.Equal(test.expect, v, test.in)
+	}
+
+	for _, in := range []string{"", "MB", "-1KB", "10XB"} {
+		_, err := parseByteSize(in)
+		assert.Error(err, in)
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMetadataURL = "http://169.254.169.254"
+	ecsMetadataURL     = "http://169.254.170.2"
+
+	// Refresh temporary credentials this long before they expire.
+	credentialsExpiryWindow = 5 * time.Minute
+
+	// How long to wait before looking again when no credentials were found.
+	credentialsRetryInterval = time.Minute
+)
+
+var errNoCredentials = errors.New("no credentials found")
+
+type credentials struct {
+	s3Keys
+
+	// Zero means never.
+	Expires time.Time
+}
+
+type credentialsProvider interface {
+	retrieve() (credentials, error)
+}
+
+// credentialsChain asks each provider in turn for credentials and caches
+// the first it gets until they are about to expire.
+type credentialsChain struct {
+	providers []credentialsProvider
+	now       func() time.Time
+
+	mu      sync.Mutex
+	current *credentials
+
+	// Set when the last lookup found nothing. We do not look again
+	// before this, and after it only in the background.
+	noneUntil time.Time
+
+	// Closed when the refresh in progress, if any, is done.
+	refreshing chan struct{}
+}
+
+func newCredentialsChain(cfg Config, host Host) *credentialsChain {
+	metadataURL := cfg.MetadataURL
+	if metadataURL == "" {
+		metadataURL = defaultMetadataURL
+	}
+
+	return &credentialsChain{
+		providers: []credentialsProvider{
+			staticCredentials{s3Keys{AccessKey: host.AccessKey, SecretKey: host.SecretKey, SessionToken: host.SessionToken}},
+			envCredentials{},
+			sharedCredentials{profile: host.Profile},
+			metadataCredentials{url: metadataURL, client: &http.Client{Timeout: 2 * time.Second}},
+		},
+		now: time.Now,
+	}
+}
+
+// keys returns the current credentials, or errNoCredentials if none of the
+// providers have any. Credentials that are about to expire are refreshed
+// in the background while they are still in use. Only the first lookup
+// blocks when there are none, e.g. for public buckets.
+func (c *credentialsChain) keys() (s3Keys, error) {
+	c.mu.Lock()
+
+	now := c.now()
+
+	if c.valid(now.Add(credentialsExpiryWindow)) {
+		defer c.mu.Unlock()
+		return c.current.s3Keys, nil
+	}
+
+	if now.Before(c.noneUntil) {
+		defer c.mu.Unlock()
+		if c.valid(now) {
+			return c.current.s3Keys, nil
+		}
+		return s3Keys{}, errNoCredentials
+	}
+
+	done := c.refresh()
+
+	if c.valid(now) {
+		defer c.mu.Unlock()
+		return c.current.s3Keys, nil
+	}
+
+	if !c.noneUntil.IsZero() {
+		c.mu.Unlock()
+		return s3Keys{}, errNoCredentials
+	}
+
+	c.mu.Unlock()
+	<-done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.current == nil {
+		return s3Keys{}, errNoCredentials
+	}
+
+	return c.current.s3Keys, nil
+}
+
+// valid reports whether the current credentials are still valid at t.
+// c.mu must be held.
+func (c *credentialsChain) valid(t time.Time) bool {
+	return c.current != nil && (c.current.Expires.IsZero() || t.Before(c.current.Expires))
+}
+
+// refresh starts asking the providers for new credentials, unless that is
+// already in progress, and returns a channel that is closed when it is done.
+// c.mu must be held.
+func (c *credentialsChain) refresh() <-chan struct{} {
+	if c.refreshing != nil {
+		return c.refreshing
+	}
+
+	done := make(chan struct{})
+	c.refreshing = done
+
+	go func() {
+		defer close(done)
+
+		creds, err := c.retrieve()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.refreshing = nil
+
+		if err == nil {
+			c.current = &creds
+			c.noneUntil = time.Time{}
+			return
+		}
+
+		now := c.now()
+		c.noneUntil = now.Add(credentialsRetryInterval)
+		if !c.valid(now) {
+			c.current = nil
+		}
+	}()
+
+	return done
+}
+
+// retrieve returns the credentials from the first provider that has any.
+// It may do network I/O, so it must not be called with c.mu held.
+func (c *credentialsChain) retrieve() (credentials, error) {
+	for _, p := range c.providers {
+		creds, err := p.retrieve()
+		if err != nil {
+			continue
+		}
+		return creds, nil
+	}
+
+	return credentials{}, errNoCredentials
+}
+
+// staticCredentials are the keys set in the config file.
+type staticCredentials struct {
+	keys s3Keys
+}
+
+func (p staticCredentials) retrieve() (credentials, error) {
+	if p.keys.AccessKey == "" || p.keys.SecretKey == "" {
+		return credentials{}, errNoCredentials
+	}
+	return credentials{s3Keys: p.keys}, nil
+}
+
+// envCredentials reads the AWS_* environment variables.
+type envCredentials struct{}
+
+func (envCredentials) retrieve() (credentials, error) {
+	keys := s3Keys{
+		AccessKey:    firstEnv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY"),
+		SecretKey:    firstEnv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	if keys.AccessKey == "" || keys.SecretKey == "" {
+		return credentials{}, errNoCredentials
+	}
+
+	return credentials{s3Keys: keys}, nil
+}
+
+func firstEnv(keys ...string) string {
+	for _, key := range keys {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// sharedCredentials reads a profile from the shared credentials file,
+// ~/.aws/credentials by default.
+type sharedCredentials struct {
+	filename string
+	profile  string
+}
+
+func (p sharedCredentials) retrieve() (credentials, error) {
+	filename := p.filename
+	if filename == "" {
+		filename = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if filename == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return credentials{}, err
+		}
+		filename = filepath.Join(home, ".aws", "credentials")
+	}
+
+	profile := p.profile
+	if profile == "" {
+		profile = firstEnv("AWS_PROFILE", "AWS_DEFAULT_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return credentials{}, err
+	}
+	defer f.Close()
+
+	var (
+		keys    s3Keys
+		section string
+	)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		if section != profile {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i == -1 {
+			continue
+		}
+
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		switch strings.ToLower(key) {
+		case "aws_access_key_id":
+			keys.AccessKey = value
+		case "aws_secret_access_key":
+			keys.SecretKey = value
+		case "aws_session_token":
+			keys.SessionToken = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return credentials{}, err
+	}
+
+	if keys.AccessKey == "" || keys.SecretKey == "" {
+		return credentials{}, fmt.Errorf("profile %q not found in %s", profile, filename)
+	}
+
+	return credentials{s3Keys: keys}, nil
+}
+
+// metadataCredentials fetches the temporary credentials of the IAM role
+// from the ECS container endpoint, if set, or else the EC2 instance
+// metadata service.
+type metadataCredentials struct {
+	url    string
+	client *http.Client
+}
+
+type metadataCredentialsResponse struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (p metadataCredentials) retrieve() (credentials, error) {
+	var credsURL string
+	header := make(http.Header)
+
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		credsURL = ecsMetadataURL + uri
+	} else if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		credsURL = uri
+	} else {
+		// IMDSv2 needs a session token. Fall back to IMDSv1 without it.
+		if token, err := p.get("PUT", "/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}}); err == nil {
+			header.Set("X-Aws-Ec2-Metadata-Token", token)
+		}
+
+		roles, err := p.get("GET", "/latest/meta-data/iam/security-credentials/", header)
+		if err != nil {
+			return credentials{}, err
+		}
+
+		role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+		if role == "" {
+			return credentials{}, errors.New("no IAM role found in instance metadata")
+		}
+
+		credsURL = strings.TrimRight(p.url, "/") + "/latest/meta-data/iam/security-credentials/" + role
+	}
+
+	body, err := p.getURL("GET", credsURL, header)
+	if err != nil {
+		return credentials{}, err
+	}
+
+	var resp metadataCredentialsResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		return credentials{}, err
+	}
+
+	if resp.AccessKeyId == "" || resp.SecretAccessKey == "" {
+		return credentials{}, errors.New("invalid credentials from metadata service")
+	}
+
+	return credentials{
+		s3Keys: s3Keys{
+			AccessKey:    resp.AccessKeyId,
+			SecretKey:    resp.SecretAccessKey,
+			SessionToken: resp.Token,
+		},
+		Expires: resp.Expiration,
+	}, nil
+}
+
+func (p metadataCredentials) get(method, path string, header http.Header) (string, error) {
+	return p.getURL(method, strings.TrimRight(p.url, "/")+path, header)
+}
+
+func (p metadataCredentials) getURL(method, url string, header http.Header) (string, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata request %s failed: %d", url, resp.StatusCode)
+	}
+
+	return string(b), nil
+}
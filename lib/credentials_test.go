@@ -0,0 +1,345 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCredentialsProvider struct {
+	// If set, retrieve blocks until this is closed.
+	release chan struct{}
+
+	mu    sync.Mutex
+	creds credentials
+	err   error
+	calls int
+}
+
+func (p *fakeCredentialsProvider) retrieve() (credentials, error) {
+	if p.release != nil {
+		<-p.release
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	return p.creds, p.err
+}
+
+func (p *fakeCredentialsProvider) set(creds credentials) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.creds = creds
+}
+
+func (p *fakeCredentialsProvider) callCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+// waitForKeys waits for a background refresh to give the expected keys.
+func waitForKeys(t testing.TB, chain *credentialsChain, accessKey string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		keys, err := chain.keys()
+		if err == nil && keys.AccessKey == accessKey {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %q, got %q (%v)", accessKey, keys.AccessKey, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForCalls waits for a background refresh to call the provider.
+func waitForCalls(t testing.TB, p *fakeCredentialsProvider, calls int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for p.callCount() < calls {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d calls, got %d", calls, p.callCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCredentialsChain(t *testing.T) {
+	assert := require.New(t)
+
+	var (
+		mu  sync.Mutex
+		now = time.Now()
+	)
+
+	setNow := func(t time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = t
+	}
+
+	getNow := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	var (
+		missing = &fakeCredentialsProvider{err: errNoCredentials}
+		temp    = &fakeCredentialsProvider{creds: credentials{s3Keys: s3Keys{AccessKey: "a1", SecretKey: "s1"}, Expires: now.Add(time.Hour)}}
+		chain   = &credentialsChain{
+			providers: []credentialsProvider{missing, temp},
+			now:       getNow,
+		}
+	)
+
+	keys, err := chain.keys()
+	assert.NoError(err)
+	assert.Equal("a1", keys.AccessKey)
+
+	keys, err = chain.keys()
+	assert.NoError(err)
+	assert.Equal("a1", keys.AccessKey)
+	assert.Equal(1, temp.callCount())
+
+	// About to expire. Keep using them while refreshing.
+	setNow(getNow().Add(57 * time.Minute))
+	temp.set(credentials{s3Keys: s3Keys{AccessKey: "a2", SecretKey: "s2"}, Expires: getNow().Add(time.Hour)})
+	waitForKeys(t, chain, "a2")
+	assert.Equal(2, temp.callCount())
+	assert.Equal(2, missing.callCount())
+
+	// Expired, so we have to wait for new ones.
+	setNow(getNow().Add(2 * time.Hour))
+	temp.set(credentials{s3Keys: s3Keys{AccessKey: "a3", SecretKey: "s3"}, Expires: getNow().Add(time.Hour)})
+	keys, err = chain.keys()
+	assert.NoError(err)
+	assert.Equal("a3", keys.AccessKey)
+
+	// None found, do not retry right away.
+	chain = &credentialsChain{
+		providers: []credentialsProvider{missing},
+		now:       getNow,
+	}
+	_, err = chain.keys()
+	assert.Equal(errNoCredentials, err)
+	_, err = chain.keys()
+	assert.Equal(errNoCredentials, err)
+	assert.Equal(4, missing.callCount())
+
+	// Looked for again in the background, without holding up the caller.
+	missing.release = make(chan struct{})
+	setNow(getNow().Add(2 * credentialsRetryInterval))
+	_, err = chain.keys()
+	assert.Equal(errNoCredentials, err)
+	close(missing.release)
+	waitForCalls(t, missing, 5)
+
+	// Found later.
+	missing.set(credentials{s3Keys: s3Keys{AccessKey: "a4", SecretKey: "s4"}})
+	missing.mu.Lock()
+	missing.err = nil
+	missing.mu.Unlock()
+	setNow(getNow().Add(2 * credentialsRetryInterval))
+	waitForKeys(t, chain, "a4")
+}
+
+func TestCredentialsChainRefreshOutsideLock(t *testing.T) {
+	assert := require.New(t)
+
+	var (
+		now  = time.Now()
+		slow = &fakeCredentialsProvider{
+			release: make(chan struct{}),
+			creds:   credentials{s3Keys: s3Keys{AccessKey: "a2", SecretKey: "s2"}, Expires: now.Add(2 * time.Hour)},
+		}
+		chain = &credentialsChain{
+			providers: []credentialsProvider{slow},
+			now:       func() time.Time { return now },
+			current:   &credentials{s3Keys: s3Keys{AccessKey: "a1", SecretKey: "s1"}, Expires: now.Add(time.Minute)},
+		}
+	)
+
+	// The expiring keys are served without waiting for the slow provider.
+	for i := 0; i < 3; i++ {
+		keys, err := chain.keys()
+		assert.NoError(err)
+		assert.Equal("a1", keys.AccessKey)
+	}
+
+	close(slow.release)
+	waitForKeys(t, chain, "a2")
+	assert.Equal(1, slow.callCount())
+
+	// Concurrent requests without usable keys share one refresh.
+	slow.release = make(chan struct{})
+	chain = &credentialsChain{
+		providers: []credentialsProvider{slow},
+		now:       func() time.Time { return now },
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results = make(chan string, 10)
+	)
+
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys, err := chain.keys()
+			if err != nil {
+				results <- err.Error()
+				return
+			}
+			results <- keys.AccessKey
+		}()
+	}
+
+	close(slow.release)
+	wg.Wait()
+	close(results)
+
+	for accessKey := range results {
+		assert.Equal("a2", accessKey)
+	}
+	assert.Equal(2, slow.callCount())
+}
+
+func TestStaticAndEnvCredentials(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := staticCredentials{}.retrieve()
+	assert.Error(err)
+
+	creds, err := staticCredentials{s3Keys{AccessKey: "a", SecretKey: "s"}}.retrieve()
+	assert.NoError(err)
+	assert.Equal("a", creds.AccessKey)
+
+	for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		defer os.Setenv(k, os.Getenv(k))
+	}
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "")
+	_, err = envCredentials{}.retrieve()
+	assert.Error(err)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "envak")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "envsk")
+	os.Setenv("AWS_SESSION_TOKEN", "envtoken")
+
+	creds, err = envCredentials{}.retrieve()
+	assert.NoError(err)
+	assert.Equal(s3Keys{AccessKey: "envak", SecretKey: "envsk", SessionToken: "envtoken"}, creds.s3Keys)
+}
+
+func TestSharedCredentials(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "s3p")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "credentials")
+	assert.NoError(ioutil.WriteFile(filename, []byte(`
+# A comment
+[default]
+aws_access_key_id = defak
+aws_secret_access_key = defsk
+
+[site]
+aws_access_key_id=siteak
+aws_secret_access_key=sitesk
+aws_session_token=sitetoken
+`), 0600))
+
+	creds, err := sharedCredentials{filename: filename, profile: "default"}.retrieve()
+	assert.NoError(err)
+	assert.Equal(s3Keys{AccessKey: "defak", SecretKey: "defsk"}, creds.s3Keys)
+
+	creds, err = sharedCredentials{filename: filename, profile: "site"}.retrieve()
+	assert.NoError(err)
+	assert.Equal(s3Keys{AccessKey: "siteak", SecretKey: "sitesk", SessionToken: "sitetoken"}, creds.s3Keys)
+
+	_, err = sharedCredentials{filename: filename, profile: "missing"}.retrieve()
+	assert.Error(err)
+
+	_, err = sharedCredentials{filename: filepath.Join(dir, "missing"), profile: "default"}.retrieve()
+	assert.Error(err)
+}
+
+func TestMetadataCredentials(t *testing.T) {
+	assert := require.New(t)
+
+	for _, k := range []string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, "")
+	}
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" {
+			w.Write([]byte("imdstoken"))
+			return
+		}
+
+		if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imdstoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("s3p-role\n"))
+		case "/latest/meta-data/iam/security-credentials/s3p-role":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Code":            "Success",
+				"AccessKeyId":     "metaak",
+				"SecretAccessKey": "metask",
+				"Token":           "metatoken",
+				"Expiration":      expires,
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	creds, err := metadataCredentials{url: ts.URL, client: http.DefaultClient}.retrieve()
+	assert.NoError(err)
+	assert.Equal(s3Keys{AccessKey: "metaak", SecretKey: "metask", SessionToken: "metatoken"}, creds.s3Keys)
+	assert.True(expires.Equal(creds.Expires))
+
+	// Via the chain and config.
+	chain := newCredentialsChain(Config{MetadataURL: ts.URL}, Host{Profile: "does-not-exist"})
+	chain.providers = append(chain.providers[:1], chain.providers[2:]...) // skip env
+	keys, err := chain.keys()
+	assert.NoError(err)
+	assert.Equal("metaak", keys.AccessKey)
+
+	_, err = metadataCredentials{url: "http://127.0.0.1:1", client: http.DefaultClient}.retrieve()
+	assert.Error(err)
+}
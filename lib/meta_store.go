@@ -0,0 +1,91 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// metaStore persists the fileMeta records. Implementations must be safe
+// for concurrent use.
+type metaStore interface {
+	// get returns nil if no record is found.
+	get(filename string) (*fileMeta, error)
+	put(m *fileMeta) error
+
+	// update calls fn with the record for filename and stores the result,
+	// with no other writes to it in between. It does nothing if no record
+	// is found.
+	update(filename string, fn func(m *fileMeta)) error
+
+	// delete returns the record it removed, or nil if none was found.
+	delete(filename string) (*fileMeta, error)
+
+	// withPrefix returns all records with a Filename starting with prefix.
+	withPrefix(prefix string) ([]fileMeta, error)
+
+	// walk calls fn for all records, the oldest first, until fn returns false.
+	walk(fn func(m fileMeta) bool) error
+
+	// bucket returns a store with its own set of records in the same
+	// database. Closing it does nothing.
+	bucket(name string) (metaStore, error)
+
+	close() error
+}
+
+const (
+	metaStoreBolt   = "bolt"
+	metaStoreMemory = "memory"
+	metaStoreSQLite = "sqlite"
+)
+
+// metaStores holds the available metadata stores. Some may need
+// to be enabled with build tags.
+var metaStores = map[string]func(cfg Config) (metaStore, error){
+	metaStoreBolt:   newBoltStore,
+	metaStoreMemory: func(cfg Config) (metaStore, error) { return newMemoryStore(), nil },
+}
+
+func newMetaStore(cfg Config) (metaStore, error) {
+	name := strings.ToLower(cfg.MetaStore)
+	if name == "" {
+		name = metaStoreBolt
+	}
+
+	create, found := metaStores[name]
+	if !found {
+		if name == metaStoreSQLite {
+			return nil, fmt.Errorf("metaStore %q not available, build with -tags sqlite", name)
+		}
+		return nil, fmt.Errorf("unknown metaStore %q", cfg.MetaStore)
+	}
+
+	return create(cfg)
+}
+
+// prefixEnd returns the smallest string greater than all strings starting
+// with prefix, or an empty string if there is none.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
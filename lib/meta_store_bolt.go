@@ -0,0 +1,186 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/boltdb/bolt"
+)
+
+// boltMetaBucket is the bucket Storm uses for the fileMeta records.
+const boltMetaBucket = "fileMeta"
+
+// boltStore stores the metadata in a Bolt database file.
+type boltStore struct {
+	db *storm.DB
+
+	// The root or one of the buckets below it.
+	node storm.Node
+}
+
+func newBoltStore(cfg Config) (metaStore, error) {
+	if err := os.MkdirAll(filepath.Dir(cfg.DBFilename), 0755); err != nil {
+		return nil, err
+	}
+
+	// Batch will group concurrent writes from cache fills into one transaction.
+	db, err := storm.Open(cfg.DBFilename, storm.Batch(), storm.BoltOptions(0600, &bolt.Options{Timeout: 10 * time.Second}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltStore{db: db, node: db}, nil
+}
+
+func (s *boltStore) get(filename string) (*fileMeta, error) {
+	var fm fileMeta
+
+	err := s.node.One("Filename", filename, &fm)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &fm, nil
+}
+
+func (s *boltStore) put(m *fileMeta) error {
+	return s.node.Save(m)
+}
+
+func (s *boltStore) update(filename string, fn func(m *fileMeta)) error {
+	// Bolt runs one writable transaction at a time.
+	tx, err := s.node.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var fm fileMeta
+	if err := tx.One("Filename", filename, &fm); err != nil {
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	fn(&fm)
+
+	if err := tx.Save(&fm); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *boltStore) delete(filename string) (*fileMeta, error) {
+	// In one transaction, so only one of concurrent deletes gets the record.
+	tx, err := s.node.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var fm fileMeta
+	if err := tx.One("Filename", filename, &fm); err != nil {
+		if err == storm.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Delete the full record to also get rid of its index entries.
+	if err := tx.DeleteStruct(&fm); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &fm, nil
+}
+
+func (s *boltStore) withPrefix(prefix string) ([]fileMeta, error) {
+	var (
+		files []fileMeta
+		codec = s.node.Codec()
+		start = []byte(prefix)
+	)
+
+	// Storm stores the records keyed by their ID, and Bolt keeps the keys
+	// sorted, so we can seek to the prefix and stop at the first mismatch.
+	err := s.db.Bolt.View(func(tx *bolt.Tx) error {
+		b := s.node.GetBucket(tx, boltMetaBucket)
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, start); k, v = c.Next() {
+			if v == nil {
+				// Nested bucket, i.e. one of Storm's indexes.
+				continue
+			}
+			var fm fileMeta
+			if err := codec.Unmarshal(v, &fm); err != nil {
+				return err
+			}
+			files = append(files, fm)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (s *boltStore) walk(fn func(m fileMeta) bool) error {
+	var files []fileMeta
+
+	if err := s.node.AllByIndex("CreatedAt", &files); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	for _, f := range files {
+		if !fn(f) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *boltStore) bucket(name string) (metaStore, error) {
+	return &boltStore{db: s.db, node: s.node.From(name)}, nil
+}
+
+func (s *boltStore) close() error {
+	if len(s.node.Bucket()) > 0 {
+		return nil
+	}
+	return s.db.Close()
+}
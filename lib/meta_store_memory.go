@@ -0,0 +1,133 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore keeps the metadata in memory only, useful for tests and
+// ephemeral containers where the cache directory does not survive a
+// restart anyway.
+type memoryStore struct {
+	mu      sync.RWMutex
+	files   map[string]fileMeta
+	buckets map[string]*memoryStore
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{files: make(map[string]fileMeta), buckets: make(map[string]*memoryStore)}
+}
+
+func (s *memoryStore) get(filename string) (*fileMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fm, found := s.files[filename]
+	if !found {
+		return nil, nil
+	}
+
+	return &fm, nil
+}
+
+func (s *memoryStore) put(m *fileMeta) error {
+	s.mu.Lock()
+	s.files[m.Filename] = *m
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) update(filename string, fn func(m *fileMeta)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fm, found := s.files[filename]
+	if !found {
+		return nil
+	}
+
+	fn(&fm)
+	s.files[filename] = fm
+
+	return nil
+}
+
+func (s *memoryStore) delete(filename string) (*fileMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fm, found := s.files[filename]
+	if !found {
+		return nil, nil
+	}
+	delete(s.files, filename)
+
+	return &fm, nil
+}
+
+func (s *memoryStore) withPrefix(prefix string) ([]fileMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var files []fileMeta
+	for filename, fm := range s.files {
+		if strings.HasPrefix(filename, prefix) {
+			files = append(files, fm)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Filename < files[j].Filename })
+
+	return files, nil
+}
+
+func (s *memoryStore) walk(fn func(m fileMeta) bool) error {
+	s.mu.RLock()
+	files := make([]fileMeta, 0, len(s.files))
+	for _, fm := range s.files {
+		files = append(files, fm)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].CreatedAt.Before(files[j].CreatedAt) })
+
+	for _, f := range files {
+		if !fn(f) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) bucket(name string) (metaStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, found := s.buckets[name]
+	if !found {
+		b = newMemoryStore()
+		s.buckets[name] = b
+	}
+
+	return b, nil
+}
+
+func (s *memoryStore) close() error {
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build sqlite
+// +build sqlite
+
+package lib
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	metaStores[metaStoreSQLite] = newSQLiteStore
+}
+
+// sqliteStore stores the metadata in an embedded SQLite database, which
+// scales better than Bolt for large caches. It needs cgo.
+type sqliteStore struct {
+	db *sql.DB
+
+	// Name of the table, one per bucket.
+	table string
+	root  bool
+}
+
+func newSQLiteStore(cfg Config) (metaStore, error) {
+	if err := os.MkdirAll(filepath.Dir(cfg.DBFilename), 0755); err != nil {
+		return nil, err
+	}
+
+	// Immediate transactions take the write lock up front, so a read and
+	// write in the same transaction, see update, cannot be interleaved.
+	db, err := sql.Open("sqlite3", cfg.DBFilename+"?_journal_mode=WAL&_busy_timeout=10000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sqliteStore{db: db, table: "file_meta", root: true}
+	if err := s.createTable(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *sqliteStore) createTable() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %[1]s (
+	filename   TEXT PRIMARY KEY,
+	created_at INTEGER NOT NULL,
+	data       BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s(created_at);
+`, sqliteQuote(s.table), sqliteQuote(s.table+"_created_at")))
+
+	return err
+}
+
+// sqliteQuote quotes an SQL identifier.
+func sqliteQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func (s *sqliteStore) get(filename string) (*fileMeta, error) {
+	var data []byte
+	err := s.db.QueryRow(s.query("SELECT data FROM %s WHERE filename = ?"), filename).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fm fileMeta
+	if err := json.Unmarshal(data, &fm); err != nil {
+		return nil, err
+	}
+
+	return &fm, nil
+}
+
+func (s *sqliteStore) put(m *fileMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(s.query("INSERT OR REPLACE INTO %s (filename, created_at, data) VALUES (?, ?, ?)"),
+		m.Filename, m.CreatedAt.UnixNano(), data)
+
+	return err
+}
+
+func (s *sqliteStore) update(filename string, fn func(m *fileMeta)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var data []byte
+	err = tx.QueryRow(s.query("SELECT data FROM %s WHERE filename = ?"), filename).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var fm fileMeta
+	if err := json.Unmarshal(data, &fm); err != nil {
+		return err
+	}
+
+	fn(&fm)
+
+	if data, err = json.Marshal(&fm); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(s.query("UPDATE %s SET created_at = ?, data = ? WHERE filename = ?"),
+		fm.CreatedAt.UnixNano(), data, filename); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) delete(filename string) (*fileMeta, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var data []byte
+	err = tx.QueryRow(s.query("SELECT data FROM %s WHERE filename = ?"), filename).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fm fileMeta
+	if err := json.Unmarshal(data, &fm); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(s.query("DELETE FROM %s WHERE filename = ?"), filename); err != nil {
+		return nil, err
+	}
+
+	return &fm, tx.Commit()
+}
+
+func (s *sqliteStore) withPrefix(prefix string) ([]fileMeta, error) {
+	// A range scan on the primary key. LIKE would need escaping.
+	var (
+		rows *sql.Rows
+		err  error
+	)
+
+	if end := prefixEnd(prefix); end != "" {
+		rows, err = s.db.Query(s.query("SELECT data FROM %s WHERE filename >= ? AND filename < ? ORDER BY filename"), prefix, end)
+	} else {
+		rows, err = s.db.Query(s.query("SELECT data FROM %s WHERE filename >= ? ORDER BY filename"), prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []fileMeta
+
+	err = s.scan(rows, func(m fileMeta) bool {
+		files = append(files, m)
+		return true
+	})
+
+	return files, err
+}
+
+func (s *sqliteStore) walk(fn func(m fileMeta) bool) error {
+	rows, err := s.db.Query(s.query("SELECT data FROM %s ORDER BY created_at"))
+	if err != nil {
+		return err
+	}
+
+	return s.scan(rows, fn)
+}
+
+func (s *sqliteStore) scan(rows *sql.Rows, fn func(m fileMeta) bool) error {
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+
+		var fm fileMeta
+		if err := json.Unmarshal(data, &fm); err != nil {
+			return err
+		}
+
+		if !fn(fm) {
+			break
+		}
+	}
+
+	return rows.Err()
+}
+
+// query inserts the table name into q.
+func (s *sqliteStore) query(q string) string {
+	return fmt.Sprintf(q, sqliteQuote(s.table))
+}
+
+func (s *sqliteStore) bucket(name string) (metaStore, error) {
+	b := &sqliteStore{db: s.db, table: "file_meta_" + name}
+	if err := b.createTable(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *sqliteStore) close() error {
+	if !s.root {
+		return nil
+	}
+	return s.db.Close()
+}
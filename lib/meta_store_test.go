@@ -0,0 +1,196 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal("b", prefixEnd("a"))
+	assert.Equal("example.org/blog0", prefixEnd("example.org/blog/"))
+	assert.Equal("b", prefixEnd("a\xff"))
+	assert.Equal("", prefixEnd("\xff\xff"))
+	assert.Equal("", prefixEnd(""))
+}
+
+func TestMetaStores(t *testing.T) {
+	for name := range metaStores {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "s3p")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			store, err := newMetaStore(Config{MetaStore: name, DBFilename: filepath.Join(dir, "db", "s3p.db")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.close()
+
+			testMetaStore(t, store)
+		})
+	}
+}
+
+func testMetaStore(t *testing.T, store metaStore) {
+	assert := require.New(t)
+
+	now := time.Now()
+
+	fm, err := store.get("missing")
+	assert.NoError(err)
+	assert.Nil(fm)
+
+	for i, filename := range []string{
+		"example.org/b/index.html",
+		"example.org/b/blog/post1.html",
+		"example.org/b/blog/post2.html",
+		"example.org/b/blog.html",
+		"example.com/b/index.html",
+		"exampleXorg/b/index.html",
+	} {
+		assert.NoError(store.put(&fileMeta{
+			Filename:   filename,
+			Size:       int64(i),
+			StatusCode: 200,
+			Header:     header{"Content-Type": {"text/html"}},
+			CreatedAt:  now.Add(time.Duration(-i) * time.Minute),
+		}))
+	}
+
+	fm, err = store.get("example.org/b/index.html")
+	assert.NoError(err)
+	assert.NotNil(fm)
+	assert.Equal(200, fm.StatusCode)
+	assert.Equal("text/html", fm.Header.get("Content-Type"))
+
+	// Update
+	fm.Size = 42
+	assert.NoError(store.put(fm))
+	fm, err = store.get("example.org/b/index.html")
+	assert.NoError(err)
+	assert.Equal(int64(42), fm.Size)
+
+	assert.NoError(store.update("example.org/b/index.html", func(m *fileMeta) {
+		m.Hits += 2
+	}))
+	assert.NoError(store.update("missing", func(m *fileMeta) {
+		t.Fatal("update called for a missing record")
+	}))
+	fm, err = store.get("example.org/b/index.html")
+	assert.NoError(err)
+	assert.Equal(int64(42), fm.Size)
+	assert.Equal(int64(2), fm.Hits)
+
+	files, err := store.withPrefix("example.org/b/blog/")
+	assert.NoError(err)
+	assert.Len(files, 2)
+
+	files, err = store.withPrefix("example.org/")
+	assert.NoError(err)
+	assert.Len(files, 4)
+	for _, f := range files {
+		assert.True(strings.HasPrefix(f.Filename, "example.org/"), f.Filename)
+	}
+
+	files, err = store.withPrefix("example.org/b/blog")
+	assert.NoError(err)
+	assert.Len(files, 3)
+
+	// Oldest first.
+	var walked []string
+	assert.NoError(store.walk(func(m fileMeta) bool {
+		walked = append(walked, m.Filename)
+		return len(walked) < 3
+	}))
+	assert.Equal([]string{"exampleXorg/b/index.html", "example.com/b/index.html", "example.org/b/blog.html"}, walked)
+
+	fm, err = store.delete("example.org/b/blog/post1.html")
+	assert.NoError(err)
+	assert.Equal("example.org/b/blog/post1.html", fm.Filename)
+	fm, err = store.delete("example.org/b/blog/post1.html")
+	assert.NoError(err)
+	assert.Nil(fm)
+	fm, err = store.get("example.org/b/blog/post1.html")
+	assert.NoError(err)
+	assert.Nil(fm)
+
+	walked = nil
+	assert.NoError(store.walk(func(m fileMeta) bool {
+		walked = append(walked, m.Filename)
+		return true
+	}))
+	assert.Len(walked, 5)
+
+	// Buckets are separate from the root and each other.
+	b1, err := store.bucket("b1")
+	assert.NoError(err)
+	b2, err := store.bucket("b2")
+	assert.NoError(err)
+
+	assert.NoError(b1.put(&fileMeta{Filename: "example.org/b/index.html", Size: 1, CreatedAt: now}))
+	assert.NoError(b1.put(&fileMeta{Filename: "example.org/b/other.html", Size: 2, CreatedAt: now}))
+
+	fm, err = store.get("example.org/b/other.html")
+	assert.NoError(err)
+	assert.Nil(fm)
+	fm, err = b2.get("example.org/b/index.html")
+	assert.NoError(err)
+	assert.Nil(fm)
+
+	files, err = b1.withPrefix("example.org/")
+	assert.NoError(err)
+	assert.Len(files, 2)
+
+	files, err = store.withPrefix("example.org/")
+	assert.NoError(err)
+	assert.Len(files, 3)
+
+	assert.NoError(b1.close())
+
+	b1, err = store.bucket("b1")
+	assert.NoError(err)
+	fm, err = b1.get("example.org/b/index.html")
+	assert.NoError(err)
+	assert.Equal(int64(1), fm.Size)
+
+	_, err = b1.delete("example.org/b/index.html")
+	assert.NoError(err)
+	fm, err = store.get("example.org/b/index.html")
+	assert.NoError(err)
+	assert.NotNil(fm)
+}
+
+func TestNewMetaStore(t *testing.T) {
+	assert := require.New(t)
+
+	store, err := newMetaStore(Config{MetaStore: "memory"})
+	assert.NoError(err)
+	assert.IsType(&memoryStore{}, store)
+
+	_, err = newMetaStore(Config{MetaStore: "redis"})
+	assert.Error(err)
+}
@@ -0,0 +1,224 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An Origin is where the cached objects are fetched from.
+type Origin interface {
+	// Get fetches the object at the given path relative to the origin root.
+	// If cond is set, its conditional headers (If-None-Match,
+	// If-Modified-Since) are honored and a 304 response is returned if the
+	// object has not changed.
+	// cond may also hold a Range header, optionally with If-Match, in which
+	// case a 206 response with that range of the object is returned. Origins
+	// without range support may return the full object with a 200 instead.
+	// The caller must close the response body.
+	Get(path string, cond http.Header) (*http.Response, error)
+
+	// Head is Get without the response body.
+	Head(path string, cond http.Header) (*http.Response, error)
+}
+
+// A Lister is an Origin that can list its objects.
+type Lister interface {
+	// List returns the paths of all objects below the given prefix.
+	List(prefix string) ([]string, error)
+}
+
+const (
+	originS3   = "s3"
+	originHTTP = "http"
+	originDir  = "dir"
+)
+
+func newOrigin(cfg Config, host Host, transport http.RoundTripper, logger *Logger) (Origin, error) {
+	switch strings.ToLower(host.Origin) {
+	case "", originS3:
+		if v := host.SignatureVersion; v != 0 && v != 2 && v != 4 {
+			return nil, fmt.Errorf("host %s: invalid signatureVersion %d", host.Name, v)
+		}
+
+		primary := newS3Client(cfg, host, transport, logger)
+		if len(host.Fallbacks) == 0 {
+			return primary, nil
+		}
+
+		origins := []Origin{primary}
+		for _, fallback := range host.Fallbacks {
+			if fallback.Bucket == "" {
+				return nil, fmt.Errorf("host %s: bucket must be set for fallbacks", host.Name)
+			}
+			fh := host
+			fh.Bucket, fh.Region, fh.Endpoint = fallback.Bucket, fallback.Region, fallback.Endpoint
+			origins = append(origins, newS3Client(cfg, fh, transport, logger))
+		}
+
+		return failoverOrigin{origins: origins, logger: logger}, nil
+	case originHTTP:
+		if host.OriginURL == "" {
+			return nil, fmt.Errorf("host %s: originURL must be set for the %q origin", host.Name, originHTTP)
+		}
+		return httpOrigin{baseURL: host.OriginURL, client: newOriginClient(cfg, host.Name, transport, logger)}, nil
+	case originDir:
+		if host.OriginDir == "" {
+			return nil, fmt.Errorf("host %s: originDir must be set for the %q origin", host.Name, originDir)
+		}
+		return dirOrigin{dir: host.OriginDir}, nil
+	default:
+		return nil, fmt.Errorf("host %s: unknown origin %q", host.Name, host.Origin)
+	}
+}
+
+// failoverOrigin tries each origin in turn until one of them does not fail.
+type failoverOrigin struct {
+	origins []Origin
+	logger  *Logger
+}
+
+func (o failoverOrigin) Get(path string, cond http.Header) (*http.Response, error) {
+	return o.try(path, func(origin Origin) (*http.Response, error) {
+		return origin.Get(path, cond)
+	})
+}
+
+func (o failoverOrigin) Head(path string, cond http.Header) (*http.Response, error) {
+	return o.try(path, func(origin Origin) (*http.Response, error) {
+		return origin.Head(path, cond)
+	})
+}
+
+func (o failoverOrigin) try(path string, get func(origin Origin) (*http.Response, error)) (*http.Response, error) {
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	for i, origin := range o.origins {
+		resp, err = get(origin)
+		if !isOriginFailure(resp, err) || i == len(o.origins)-1 {
+			break
+		}
+
+		if resp != nil {
+			o.logger.Error("area", "origin", "tag", "failover", "path", path, "status", resp.StatusCode)
+			resp.Body.Close()
+		} else {
+			o.logger.Error("area", "origin", "tag", "failover", "path", path, "error", err)
+		}
+	}
+
+	return resp, err
+}
+
+func (o failoverOrigin) List(prefix string) ([]string, error) {
+	err := errors.New("no origin supports listing")
+	for _, origin := range o.origins {
+		lister, ok := origin.(Lister)
+		if !ok {
+			continue
+		}
+		var keys []string
+		keys, err = lister.List(prefix)
+		if err == nil {
+			return keys, nil
+		}
+	}
+	return nil, err
+}
+
+// originURL returns the URL of the object as fetched from the origin, if known.
+func originURL(resp *http.Response) string {
+	if resp.Request == nil || resp.Request.URL == nil {
+		return ""
+	}
+	u := *resp.Request.URL
+	u.RawQuery = ""
+	return u.String()
+}
+
+// We store and replay all origin headers not in this list.
+var originHeadersBlacklist = map[string]bool{
+	"Server":         true,
+	"Content-Length": true,
+
+	"Date":             true,
+	"Accept-Ranges":    true,
+	"X-Amz-Request-Id": true,
+	"X-Amz-Id-2":       true,
+
+	// Hop-by-hop headers.
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+}
+
+func newFileMeta(relPath string, resp *http.Response) *fileMeta {
+	h := make(header)
+
+	for k, v := range resp.Header {
+		if originHeadersBlacklist[k] {
+			continue
+		}
+		for _, vv := range v {
+			h[k] = append(h[k], vv)
+		}
+	}
+
+	now := time.Now()
+
+	return &fileMeta{
+		Filename:   relPath,
+		OriginURL:  originURL(resp),
+		Size:       resp.ContentLength,
+		ModTime:    lastModified(h, now),
+		StatusCode: resp.StatusCode,
+		Header:     h,
+		CreatedAt:  now,
+	}
+}
+
+// lastModified returns the Last-Modified time in h, or fallback if it has none.
+// Using the origin's time keeps it stable across fetches, so clients can
+// revalidate their copies.
+func lastModified(h header, fallback time.Time) time.Time {
+	if t, err := http.ParseTime(h.get("Last-Modified")); err == nil {
+		return t
+	}
+	return fallback
+}
+
+// conditionalHeader returns the headers needed to ask the origin whether
+// the object has changed since m was stored.
+func (m *fileMeta) conditionalHeader() http.Header {
+	cond := make(http.Header)
+	if etag := m.Header.get("Etag"); etag != "" {
+		cond.Set("If-None-Match", etag)
+	}
+	if lastModified := m.Header.get("Last-Modified"); lastModified != "" {
+		cond.Set("If-Modified-Since", lastModified)
+	}
+	return cond
+}
+
+func cacheableStatusCode(status int) bool {
+	return status == http.StatusOK || status == http.StatusNotFound
+}
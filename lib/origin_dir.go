@@ -0,0 +1,171 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dirOrigin is an Origin backed by a local directory, useful for
+// development and testing.
+type dirOrigin struct {
+	dir string
+}
+
+func (o dirOrigin) Get(p string, cond http.Header) (*http.Response, error) {
+	// Make sure we stay inside dir.
+	filename := filepath.Join(o.dir, filepath.FromSlash(path.Clean("/"+p)))
+
+	fi, err := os.Stat(filename)
+	if err != nil || fi.IsDir() {
+		if err == nil || os.IsNotExist(err) {
+			return o.response(filename, http.StatusNotFound, nil), nil
+		}
+		return nil, err
+	}
+
+	modTime := fi.ModTime().UTC()
+	etag := fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), fi.Size())
+
+	h := make(http.Header)
+	h.Set("Etag", etag)
+	h.Set("Last-Modified", modTime.Format(http.TimeFormat))
+
+	if cond.Get("If-None-Match") == etag {
+		return o.response(filename, http.StatusNotModified, h), nil
+	}
+
+	if ims, err := http.ParseTime(cond.Get("If-Modified-Since")); err == nil && !modTime.Truncate(time.Second).After(ims) {
+		return o.response(filename, http.StatusNotModified, h), nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctype := mime.TypeByExtension(filepath.Ext(filename)); ctype != "" {
+		h.Set("Content-Type", ctype)
+	}
+
+	if r, ok := parseRange(cond.Get("Range")); ok {
+		if cond.Get("If-Match") != "" && cond.Get("If-Match") != etag {
+			f.Close()
+			return o.response(filename, http.StatusPreconditionFailed, h), nil
+		}
+
+		start, end, ok := r.resolve(fi.Size())
+		if !ok {
+			f.Close()
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", fi.Size()))
+			return o.response(filename, http.StatusRequestedRangeNotSatisfiable, h), nil
+		}
+
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		length := end - start + 1
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fi.Size()))
+		h.Set("Content-Length", strconv.FormatInt(length, 10))
+
+		resp := o.response(filename, http.StatusPartialContent, h)
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, length), f}
+		resp.ContentLength = length
+
+		return resp, nil
+	}
+
+	h.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+
+	resp := o.response(filename, http.StatusOK, h)
+	resp.Body = f
+	resp.ContentLength = fi.Size()
+
+	return resp, nil
+}
+
+func (o dirOrigin) Head(p string, cond http.Header) (*http.Response, error) {
+	resp, err := o.Get(p, cond)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(strings.NewReader(""))
+	resp.Request.Method = "HEAD"
+	return resp, nil
+}
+
+func (o dirOrigin) response(filename string, status int, h http.Header) *http.Response {
+	if h == nil {
+		h = make(http.Header)
+	}
+	return &http.Response{
+		Request: &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Scheme: "file", Path: filepath.ToSlash(filename)},
+		},
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(strings.NewReader("")),
+		ContentLength: 0,
+	}
+}
+
+func (o dirOrigin) List(prefix string) ([]string, error) {
+	var keys []string
+
+	err := filepath.Walk(o.dir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(o.dir, filename)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	return keys, err
+}
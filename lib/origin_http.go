@@ -0,0 +1,54 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"net/http"
+	"strings"
+)
+
+// httpOrigin is an Origin backed by any HTTP server, e.g. a bucket
+// configured for static website hosting.
+type httpOrigin struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (o httpOrigin) Get(path string, cond http.Header) (*http.Response, error) {
+	return o.get("GET", path, cond)
+}
+
+func (o httpOrigin) Head(path string, cond http.Header) (*http.Response, error) {
+	return o.get("HEAD", path, cond)
+}
+
+func (o httpOrigin) get(method, path string, cond http.Header) (*http.Response, error) {
+	url := strings.TrimRight(o.baseURL, "/") + "/" + strings.TrimLeft(path, "/")
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range cond {
+		req.Header[k] = v
+	}
+
+	// Unlike S3, a HTTP server may compress the response if we let it, and
+	// we serve the same bytes to every client, with or without gzip support.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	return o.client.Do(req)
+}
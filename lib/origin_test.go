@@ -0,0 +1,292 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewOrigin(t *testing.T) {
+	assert := require.New(t)
+
+	logger := NewLogger(log.NewNopLogger())
+
+	o, err := newOrigin(Config{}, Host{Name: "a", Bucket: "b"}, http.DefaultTransport, logger)
+	assert.NoError(err)
+	assert.IsType(s3Client{}, o)
+
+	o, err = newOrigin(Config{}, Host{Name: "a", Origin: "http", OriginURL: "http://example.org"}, http.DefaultTransport, logger)
+	assert.NoError(err)
+	assert.IsType(httpOrigin{}, o)
+
+	o, err = newOrigin(Config{}, Host{Name: "a", Origin: "dir", OriginDir: "public"}, http.DefaultTransport, logger)
+	assert.NoError(err)
+	assert.IsType(dirOrigin{}, o)
+
+	_, err = newOrigin(Config{}, Host{Name: "a", Origin: "http"}, http.DefaultTransport, logger)
+	assert.Error(err)
+	_, err = newOrigin(Config{}, Host{Name: "a", Origin: "dir"}, http.DefaultTransport, logger)
+	assert.Error(err)
+	_, err = newOrigin(Config{}, Host{Name: "a", Origin: "ftp"}, http.DefaultTransport, logger)
+	assert.Error(err)
+	_, err = newOrigin(Config{}, Host{Name: "a", SignatureVersion: 3}, http.DefaultTransport, logger)
+	assert.Error(err)
+
+	o, err = newOrigin(Config{}, Host{Name: "a", Bucket: "b", Fallbacks: []Fallback{{Bucket: "b2", Region: "eu-west-1"}}}, http.DefaultTransport, logger)
+	assert.NoError(err)
+	assert.IsType(failoverOrigin{}, o)
+	fo := o.(failoverOrigin)
+	assert.Len(fo.origins, 2)
+	assert.Equal("https://b2.s3.eu-west-1.amazonaws.com/a", fo.origins[1].(s3Client).url("a", nil).String())
+
+	_, err = newOrigin(Config{}, Host{Name: "a", Bucket: "b", Fallbacks: []Fallback{{Region: "eu-west-1"}}}, http.DefaultTransport, logger)
+	assert.Error(err)
+}
+
+func TestDirOrigin(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "s3p")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "blog"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>Home</h1>"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "blog", "post.html"), []byte("<h1>Post</h1>"), 0644))
+
+	o := dirOrigin{dir: dir}
+
+	resp, err := o.Get("index.html", nil)
+	assert.NoError(err)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("<h1>Home</h1>", string(b))
+	assert.Equal("text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(int64(13), resp.ContentLength)
+
+	etag := resp.Header.Get("Etag")
+	assert.NotEmpty(etag)
+
+	resp, err = o.Head("index.html", nil)
+	assert.NoError(err)
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Empty(b)
+	assert.Equal(int64(13), resp.ContentLength)
+	assert.Equal(etag, resp.Header.Get("Etag"))
+
+	cond := make(http.Header)
+	cond.Set("If-None-Match", etag)
+	resp, err = o.Get("index.html", cond)
+	assert.NoError(err)
+	assert.Equal(http.StatusNotModified, resp.StatusCode)
+
+	cond = make(http.Header)
+	cond.Set("If-Modified-Since", resp.Header.Get("Last-Modified"))
+	resp, err = o.Get("index.html", cond)
+	assert.NoError(err)
+	assert.Equal(http.StatusNotModified, resp.StatusCode)
+
+	cond = make(http.Header)
+	cond.Set("Range", "bytes=4-7")
+	resp, err = o.Get("index.html", cond)
+	assert.NoError(err)
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(http.StatusPartialContent, resp.StatusCode)
+	assert.Equal("Home", string(b))
+	assert.Equal("bytes 4-7/13", resp.Header.Get("Content-Range"))
+
+	cond.Set("Range", "bytes=20-")
+	resp, err = o.Get("index.html", cond)
+	assert.NoError(err)
+	assert.Equal(http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	assert.Equal("bytes */13", resp.Header.Get("Content-Range"))
+
+	cond.Set("Range", "bytes=0-3")
+	cond.Set("If-Match", `"other"`)
+	resp, err = o.Get("index.html", cond)
+	assert.NoError(err)
+	assert.Equal(http.StatusPreconditionFailed, resp.StatusCode)
+
+	for _, p := range []string{"missing.html", "blog", "../../../etc/passwd"} {
+		resp, err = o.Get(p, nil)
+		assert.NoError(err)
+		assert.Equal(http.StatusNotFound, resp.StatusCode, p)
+	}
+
+	keys, err := o.List("")
+	assert.NoError(err)
+	assert.Equal([]string{"blog/post.html", "index.html"}, keys)
+
+	keys, err = o.List("blog/")
+	assert.NoError(err)
+	assert.Equal([]string{"blog/post.html"}, keys)
+}
+
+func TestHTTPOrigin(t *testing.T) {
+	assert := require.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Etag", `"v1"`)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(r.URL.Path))
+			gz.Close()
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	o := httpOrigin{baseURL: ts.URL + "/", client: http.DefaultClient}
+
+	resp, err := o.Get("/blog/post.html", nil)
+	assert.NoError(err)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal("/blog/post.html", string(b))
+	assert.Empty(resp.Header.Get("Content-Encoding"))
+
+	cond := make(http.Header)
+	cond.Set("If-None-Match", `"v1"`)
+	resp, err = o.Get("blog/post.html", cond)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNotModified, resp.StatusCode)
+}
+
+func TestCacheWithDirOrigin(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "s3p")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	publicDir := filepath.Join(dir, "public")
+	assert.NoError(os.MkdirAll(publicDir, 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(publicDir, "index.html"), []byte("<h1>Home</h1>"), 0644))
+
+	cfg := Config{
+		CacheDir:   filepath.Join(dir, "cache"),
+		DBFilename: filepath.Join(dir, "s3p.db"),
+		Hosts: map[string]Host{
+			"example.org": {Name: "example.org", Origin: "dir", OriginDir: publicDir},
+		},
+	}
+
+	c, err := newCache(cfg, NewLogger(log.NewNopLogger()))
+	assert.NoError(err)
+	defer c.close()
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		assert.NoError(c.handleRequest(rec, httptest.NewRequest("GET", "http://example.org/", nil)))
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal("<h1>Home</h1>", rec.Body.String())
+	}
+
+	_, err = os.Stat(filepath.Join(cfg.CacheDir, "example.org", "index.html"))
+	assert.NoError(err)
+}
+
+func TestFailoverOrigin(t *testing.T) {
+	assert := require.New(t)
+
+	logger := NewLogger(log.NewNopLogger())
+
+	newS3 := func(bucket string, status int, err error) s3Client {
+		host := Host{Name: "example.org", Bucket: bucket, AccessKey: "ak", SecretKey: "sk"}
+		return s3Client{
+			host:   host,
+			creds:  newCredentialsChain(Config{}, host),
+			logger: logger,
+			client: &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if err != nil {
+					return nil, err
+				}
+				resp := newTestResponse(req, status)
+				resp.Body = ioutil.NopCloser(strings.NewReader(bucket))
+				return resp, nil
+			})},
+		}
+	}
+
+	get := func(o Origin) (*http.Response, string, error) {
+		resp, err := o.Get("index.html", nil)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(b), nil
+	}
+
+	o := failoverOrigin{logger: logger, origins: []Origin{
+		newS3("b1", http.StatusServiceUnavailable, nil),
+		newS3("b2", 0, errors.New("connection refused")),
+		newS3("b3", http.StatusOK, nil),
+	}}
+
+	resp, body, err := get(o)
+	assert.NoError(err)
+	assert.Equal("b3", body)
+	assert.Equal("https://b3.s3.amazonaws.com/index.html", originURL(resp))
+
+	// 404 is not a failure.
+	o.origins[0] = newS3("b1", http.StatusNotFound, nil)
+	resp, body, err = get(o)
+	assert.NoError(err)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+	assert.Equal("b1", body)
+
+	// All failing, return the last.
+	o.origins = o.origins[1:2]
+	_, _, err = get(o)
+	assert.Error(err)
+}
+
+func TestCacheRecordsOriginURL(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{objects: map[string]string{"/index.html": "v1"}}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	assert.NoError(c.handleRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.org/", nil)))
+
+	meta, err := c.getFileMeta("example.org/bucket1/index.html")
+	assert.NoError(err)
+	assert.Equal("https://bucket1.s3.amazonaws.com/index.html", meta.OriginURL)
+}
@@ -0,0 +1,245 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOriginConnectTimeout        = 5 * time.Second
+	defaultOriginResponseHeaderTimeout = 30 * time.Second
+	defaultOriginTimeout               = 10 * time.Minute
+	defaultOriginRetries               = 2
+	defaultOriginRetryBackoff          = 100 * time.Millisecond
+	maxOriginRetryBackoff              = 5 * time.Second
+	defaultBreakerThreshold            = 5
+	defaultBreakerCooldown             = 30 * time.Second
+)
+
+// errCircuitOpen is returned without asking the origin when it has failed
+// too many times in a row.
+var errCircuitOpen = errors.New("origin unavailable: circuit breaker open")
+
+func durationOrDefault(d duration, def time.Duration) time.Duration {
+	if d.Duration <= 0 {
+		return def
+	}
+	return d.Duration
+}
+
+// newOriginTransport creates the transport shared by all the origins.
+func newOriginTransport(cfg Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   durationOrDefault(cfg.OriginConnectTimeout, defaultOriginConnectTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: durationOrDefault(cfg.OriginResponseHeaderTimeout, defaultOriginResponseHeaderTimeout),
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// newOriginClient creates the HTTP client for the named origin, with
+// retries and a circuit breaker of its own.
+func newOriginClient(cfg Config, name string, transport http.RoundTripper, logger *Logger) *http.Client {
+	retries := cfg.OriginRetries
+	if retries == 0 {
+		retries = defaultOriginRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+
+	threshold := cfg.BreakerThreshold
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+
+	return &http.Client{
+		Timeout: durationOrDefault(cfg.OriginTimeout, defaultOriginTimeout),
+		Transport: &breakerTransport{
+			next: &retryTransport{
+				next:    transport,
+				retries: retries,
+				backoff: defaultOriginRetryBackoff,
+			},
+			breaker: newBreaker(name, threshold, durationOrDefault(cfg.BreakerCooldown, defaultBreakerCooldown), logger),
+		},
+	}
+}
+
+// isOriginFailure reports whether the origin is to blame for a failed request.
+func isOriginFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+// retryTransport retries idempotent requests on network errors and 5xx
+// responses with an exponential, jittered backoff.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" || req.Body != nil && req.Body != http.NoBody {
+		return t.next.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.retries || !isOriginFailure(resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(t.backoffFor(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// backoffFor returns a random wait between 0 and backoff * 2^attempt.
+func (t *retryTransport) backoffFor(attempt int) time.Duration {
+	max := t.backoff << uint(attempt)
+	if max <= 0 || max > maxOriginRetryBackoff {
+		max = maxOriginRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is a circuit breaker. It opens after threshold failures in a row
+// and lets a single trial request through when cooldown has passed. That
+// request decides whether it closes again.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	logger    *Logger
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(name string, threshold int, cooldown time.Duration, logger *Logger) *breaker {
+	return &breaker{name: name, threshold: threshold, cooldown: cooldown, logger: logger, now: time.Now}
+}
+
+// allow reports whether a request may be sent to the origin.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// Wait for the trial request.
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *breaker) done(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		if b.state != breakerOpen {
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+func (b *breaker) setState(state breakerState) {
+	b.state = state
+	if state == breakerOpen {
+		b.logger.Error("area", "origin", "host", b.name, "breaker", state, "failures", b.failures)
+	} else {
+		b.logger.Info("area", "origin", "host", b.name, "breaker", state)
+	}
+}
+
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *breaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	t.breaker.done(isOriginFailure(resp, err))
+
+	return resp, err
+}
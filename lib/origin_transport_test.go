@@ -0,0 +1,151 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestResponse(req *http.Request, status int) *http.Response {
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}
+}
+
+func TestRetryTransport(t *testing.T) {
+	assert := require.New(t)
+
+	var (
+		calls    int
+		statuses []int
+		errs     []error
+	)
+
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		i := calls
+		calls++
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		return newTestResponse(req, statuses[i]), nil
+	})
+
+	rt := &retryTransport{next: next, retries: 2, backoff: time.Millisecond}
+
+	for i, test := range []struct {
+		method   string
+		statuses []int
+		errs     []error
+		expect   int
+		calls    int
+	}{
+		{"GET", []int{200}, []error{nil}, 200, 1},
+		{"GET", []int{404}, []error{nil}, 404, 1},
+		{"GET", []int{503, 500, 200}, []error{nil, nil, nil}, 200, 3},
+		{"GET", []int{0, 200}, []error{errors.New("connection refused"), nil}, 200, 2},
+		{"GET", []int{503, 503, 502, 200}, []error{nil, nil, nil, nil}, 502, 3},
+		{"HEAD", []int{500, 200}, []error{nil, nil}, 200, 2},
+		{"POST", []int{500, 200}, []error{nil, nil}, 500, 1},
+	} {
+		calls, statuses, errs = 0, test.statuses, test.errs
+		req := httptest.NewRequest(test.method, "http://example.org/", nil)
+		req.Body = nil
+		resp, err := rt.RoundTrip(req)
+		assert.NoError(err, "[%d]", i)
+		assert.Equal(test.expect, resp.StatusCode, "[%d]", i)
+		assert.Equal(test.calls, calls, "[%d]", i)
+	}
+
+	for attempt := 0; attempt < 20; attempt++ {
+		assert.True(rt.backoffFor(attempt) <= maxOriginRetryBackoff)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Now()
+	b := newBreaker("example.org", 3, time.Minute, NewLogger(log.NewNopLogger()))
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		assert.True(b.allow())
+		b.done(true)
+	}
+
+	// A success resets the count.
+	assert.True(b.allow())
+	b.done(false)
+
+	for i := 0; i < 3; i++ {
+		assert.True(b.allow())
+		b.done(true)
+	}
+
+	assert.Equal(breakerOpen, b.state)
+	assert.False(b.allow())
+
+	// Let one through after the cooldown.
+	now = now.Add(2 * time.Minute)
+	assert.True(b.allow())
+	assert.Equal(breakerHalfOpen, b.state)
+	assert.False(b.allow())
+
+	// Which fails.
+	b.done(true)
+	assert.Equal(breakerOpen, b.state)
+	assert.False(b.allow())
+
+	now = now.Add(2 * time.Minute)
+	assert.True(b.allow())
+	b.done(false)
+	assert.Equal(breakerClosed, b.state)
+	assert.True(b.allow())
+}
+
+func TestOriginClient(t *testing.T) {
+	assert := require.New(t)
+
+	var requests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	cfg := Config{OriginRetries: -1, BreakerThreshold: 2}
+	client := newOriginClient(cfg, "example.org", newOriginTransport(cfg), NewLogger(log.NewNopLogger()))
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL)
+		assert.NoError(err)
+		resp.Body.Close()
+		assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	_, err := client.Get(ts.URL)
+	assert.Error(err)
+	assert.True(errors.Is(err, errCircuitOpen))
+	assert.Equal(int32(2), atomic.LoadInt32(&requests))
+}
@@ -15,121 +15,183 @@
 package lib
 
 import (
+	"encoding/xml"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
-
-	"github.com/kr/s3"
 )
 
-// We store and replay all S3 headers not in this list.
-var s3HeadersBlacklist = map[string]bool{
-	"Server":         true,
-	"Content-Length": true,
-
-	"Date":             true,
-	"Accept-Ranges":    true,
-	"X-Amz-Request-Id": true,
-	"X-Amz-Id-2":       true,
-}
-
+// s3Client is an Origin backed by an Amazon S3 bucket.
 type s3Client struct {
-	cfg    Config
+	host   Host
+	creds  *credentialsChain
 	logger *Logger
+	client *http.Client
 }
 
-func (s s3Client) getAndWrite(path string, host Host,
-	w io.Writer, rw http.ResponseWriter, req *http.Request) (*fileMeta, error) {
+const defaultS3Region = "us-east-1"
 
-	// TODO(bep) https
-	url := fmt.Sprintf("http://%s.s3.amazonaws.com/%s", host.Bucket, host.bucketPath(path))
+func (s s3Client) region() string {
+	if s.host.Region == "" {
+		return defaultS3Region
+	}
+	return s.host.Region
+}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+// url returns the URL to the given key in the bucket, or to the bucket
+// itself if key is empty.
+func (s s3Client) url(key string, query url.Values) *url.URL {
+	u := &url.URL{Scheme: "https", Host: s.host.Endpoint}
+
+	if s.host.UseSSL != nil && !*s.host.UseSSL {
+		u.Scheme = "http"
 	}
 
-	// We will store the Content-Encoding header and replay that later.
-	req.Header.Add("Accept-Encoding", "gzip")
-	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if i := strings.Index(u.Host, "://"); i != -1 {
+		u.Scheme, u.Host = u.Host[:i], strings.TrimRight(u.Host[i+3:], "/")
+	}
+
+	if u.Host == "" {
+		if region := s.region(); region == defaultS3Region {
+			u.Host = "s3.amazonaws.com"
+		} else {
+			u.Host = fmt.Sprintf("s3.%s.amazonaws.com", region)
+		}
+	}
 
-	s3.Sign(req, s3.Keys{
-		AccessKey: host.AccessKey,
-		SecretKey: host.SecretKey,
-	})
+	key = strings.TrimLeft(key, "/")
+
+	// Dotted bucket names do not match the wildcard certificate.
+	pathStyle := s.host.PathStyle || (u.Scheme == "https" && strings.Contains(s.host.Bucket, "."))
+
+	if pathStyle {
+		u.Path = "/" + s.host.Bucket + "/" + key
+	} else {
+		u.Host = s.host.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+
+	return u
+}
+
+func newS3Client(cfg Config, host Host, transport http.RoundTripper, logger *Logger) s3Client {
+	return s3Client{
+		host:   host,
+		creds:  newCredentialsChain(cfg, host),
+		logger: logger,
+		client: newOriginClient(cfg, host.Name+"/"+host.Bucket, transport, logger),
+	}
+}
+
+func (s s3Client) Get(path string, cond http.Header) (*http.Response, error) {
+	return s.get("GET", path, cond)
+}
 
-	resp, err := http.DefaultClient.Do(req)
+func (s s3Client) Head(path string, cond http.Header) (*http.Response, error) {
+	return s.get("HEAD", path, cond)
+}
+
+func (s s3Client) get(method, path string, cond http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(path, nil).String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
+	for k, v := range cond {
+		req.Header[k] = v
+	}
 
-	if !s.cacheableStatusCode(resp.StatusCode) {
-		return nil, fmt.Errorf("Failed for path %s: %d", path, resp.StatusCode)
+	// We will store the Content-Encoding header and replay that later.
+	// Byte ranges are always of the uncompressed object.
+	if req.Header.Get("Range") == "" {
+		req.Header.Add("Accept-Encoding", "gzip")
 	}
 
-	statusOK := resp.StatusCode == http.StatusOK
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
 
-	h := make(header)
+	s.logger.Debug("area", "s3", "method", method, "path", path, "status", resp.StatusCode)
 
-	keyContentType := "Content-Type"
-	textPlain := "text/plain"
+	return resp, nil
+}
 
-	for k, v := range resp.Header {
-		if s3HeadersBlacklist[k] {
-			continue
-		}
-		if !statusOK && strings.EqualFold(k, keyContentType) {
-			// Prevent XML errors from S3
-			h[k] = append(h[k], textPlain)
-			continue
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s s3Client) List(prefix string) ([]string, error) {
+	var (
+		keys  []string
+		token string
+	)
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
 		}
-		for _, vv := range v {
-			h[k] = append(h[k], vv)
+
+		req, err := http.NewRequest("GET", s.url("", query).String(), nil)
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	now := time.Now()
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
 
-	fm := &fileMeta{
-		Filename:   host.hostPath(path),
-		Size:       resp.ContentLength,
-		ModTime:    now, // TODO(bep)
-		StatusCode: resp.StatusCode,
-		Header:     h,
-		CreatedAt:  now,
-	}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
 
-	for k, v := range fm.Header {
-		for _, vv := range v {
-			rw.Header().Add(k, vv)
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to list bucket %s: %d", s.host.Bucket, resp.StatusCode)
 		}
-	}
 
-	rw.WriteHeader(resp.StatusCode)
+		if err != nil {
+			return nil, err
+		}
 
-	s.logger.Debug("area", "s3", "filename", fm.Filename, "status", resp.StatusCode)
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
 
-	var content io.Reader
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
 
-	// TODO(bep) consider the error page cache
-	if statusOK {
-		content = resp.Body
-	} else {
-		content = strings.NewReader(resp.Status)
+		token = result.NextContinuationToken
 	}
+}
 
-	_, err = io.Copy(w, content)
+func (s s3Client) do(req *http.Request) (*http.Response, error) {
+	keys, err := s.creds.keys()
 	if err != nil {
-		return nil, err
+		// Try anonymous access, e.g. for a public bucket.
+		s.logger.Debug("area", "s3", "bucket", s.host.Bucket, "credentials", err)
+		return s.client.Do(req)
 	}
 
-	return fm, nil
-}
+	if s.host.SignatureVersion == 2 {
+		signV2(req, keys, time.Now())
+	} else {
+		signV4(req, keys, s.region(), "s3", time.Now())
+	}
 
-func (s s3Client) cacheableStatusCode(status int) bool {
-	return status == http.StatusOK || status == http.StatusNotFound
+	return s.client.Do(req)
 }
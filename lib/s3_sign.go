@@ -0,0 +1,186 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kr/s3"
+)
+
+const (
+	v4Algorithm  = "AWS4-HMAC-SHA256"
+	v4TimeFormat = "20060102T150405Z"
+	v4DateFormat = "20060102"
+
+	// SHA256 of an empty body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Keys are the credentials used to sign requests to S3.
+type s3Keys struct {
+	AccessKey string
+	SecretKey string
+
+	// Set for temporary credentials.
+	SessionToken string
+}
+
+// signV2 signs req with the legacy AWS Signature Version 2.
+func signV2(req *http.Request, keys s3Keys, now time.Time) {
+	req.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+	s3.Sign(req, s3.Keys{
+		AccessKey:     keys.AccessKey,
+		SecretKey:     keys.SecretKey,
+		SecurityToken: keys.SessionToken,
+	})
+}
+
+// signV4 signs req, which must have an empty body, with AWS Signature Version 4.
+// See http://docs.aws.amazon.com/general/latest/gr/signature-version-4.html
+func signV4(req *http.Request, keys s3Keys, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(v4TimeFormat)
+	scope := strings.Join([]string{now.Format(v4DateFormat), region, service, "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	}
+	if keys.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", keys.SessionToken)
+	}
+
+	// Make sure we send the path exactly as signed.
+	canonicalURI := v4EscapePath(req.URL.Path)
+	req.URL.RawPath = canonicalURI
+
+	signedHeaders, canonicalHeaders := v4CanonicalHeaders(req)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		v4CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		v4Algorithm,
+		amzDate,
+		scope,
+		sha256Hex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+keys.SecretKey), now.Format(v4DateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		v4Algorithm, keys.AccessKey, scope, signedHeaders, signature))
+}
+
+func v4CanonicalHeaders(req *http.Request) (signed, canonical string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	values := map[string]string{"host": host}
+
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "content-type" || k == "content-md5" || k == "range" {
+			trimmed := make([]string, len(v))
+			for i, vv := range v {
+				trimmed[i] = strings.Join(strings.Fields(vv), " ")
+			}
+			values[k] = strings.Join(trimmed, ",")
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(values[k])
+		b.WriteByte('\n')
+	}
+
+	return strings.Join(keys, ";"), b.String()
+}
+
+func v4CanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for k, vs := range query {
+		for _, v := range vs {
+			pairs = append(pairs, v4Escape(k, true)+"="+v4Escape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func v4EscapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return v4Escape(p, false)
+}
+
+// v4Escape escapes s as required by AWS: all but the unreserved
+// characters are percent-encoded. Slashes are kept unless escapeSlash is set.
+func v4Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,87 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3ClientURL(t *testing.T) {
+	assert := require.New(t)
+
+	no := false
+
+	for i, test := range []struct {
+		host   Host
+		key    string
+		expect string
+	}{
+		{Host{Bucket: "b"}, "index.html", "https://b.s3.amazonaws.com/index.html"},
+		{Host{Bucket: "b"}, "/a b/c.html", "https://b.s3.amazonaws.com/a%20b/c.html"},
+		{Host{Bucket: "b", UseSSL: &no}, "index.html", "http://b.s3.amazonaws.com/index.html"},
+		{Host{Bucket: "b", Region: "eu-west-1"}, "index.html", "https://b.s3.eu-west-1.amazonaws.com/index.html"},
+		{Host{Bucket: "b", Region: "eu-west-1", PathStyle: true}, "index.html", "https://s3.eu-west-1.amazonaws.com/b/index.html"},
+		{Host{Bucket: "example.org"}, "index.html", "https://s3.amazonaws.com/example.org/index.html"},
+		{Host{Bucket: "example.org", UseSSL: &no}, "index.html", "http://example.org.s3.amazonaws.com/index.html"},
+		{Host{Bucket: "b", Endpoint: "localhost:9000", UseSSL: &no, PathStyle: true}, "index.html", "http://localhost:9000/b/index.html"},
+		{Host{Bucket: "b", Endpoint: "nyc3.digitaloceanspaces.com"}, "index.html", "https://b.nyc3.digitaloceanspaces.com/index.html"},
+		{Host{Bucket: "b", Endpoint: "http://minio:9000/", PathStyle: true}, "index.html", "http://minio:9000/b/index.html"},
+		{Host{Bucket: "b"}, "", "https://b.s3.amazonaws.com/"},
+	} {
+		s := s3Client{host: test.host}
+		assert.Equal(test.expect, s.url(test.key, nil).String(), "[%d]", i)
+	}
+
+	s := s3Client{host: Host{Bucket: "b", Endpoint: "localhost:9000", PathStyle: true}}
+	assert.Equal("https://localhost:9000/b/?list-type=2&prefix=blog%2F",
+		s.url("", url.Values{"list-type": {"2"}, "prefix": {"blog/"}}).String())
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestS3ClientSigning(t *testing.T) {
+	assert := require.New(t)
+
+	var authorization string
+
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		authorization = req.Header.Get("Authorization")
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}
+
+	logger := NewLogger(log.NewNopLogger())
+
+	host := Host{Bucket: "b", AccessKey: "ak", SecretKey: "sk"}
+	s := s3Client{host: host, creds: newCredentialsChain(Config{}, host), logger: logger, client: client}
+	_, err := s.Get("index.html", nil)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=ak/"), authorization)
+
+	s.host.SignatureVersion = 2
+	_, err = s.Get("index.html", nil)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(authorization, "AWS ak:"), authorization)
+}
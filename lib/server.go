@@ -16,9 +16,13 @@ package lib
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"crypto/tls"
 
@@ -36,8 +40,13 @@ type Server struct {
 	tlsEnabled bool
 
 	logger *Logger
+	cache  *cache
 
 	server *http.Server
+
+	// Stops the cache maintenance.
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 type httpHandlers struct {
@@ -47,9 +56,13 @@ type httpHandlers struct {
 func NewServer(cfg Config, logger *Logger) (*Server, error) {
 	// TODO(bep) validate config
 
+	c, err := newCache(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
 	var (
 		h  = http.NewServeMux()
-		c  = newCache(cfg, logger)
 		mw = &httpHandlers{c: c}
 	)
 
@@ -61,19 +74,55 @@ func NewServer(cfg Config, logger *Logger) (*Server, error) {
 			return
 		}
 
-		prefix = path.Join(host.Name, prefix)
+		prefix = host.purgePrefix(prefix)
 
-		if err := c.purgePrefix(prefix); err != nil {
-			c.logger.Error("area", "cache", "tag", "purge", "prefix", prefix, "error", err)
+		if r.Form["tag"] != nil {
+			tags := parseTags(strings.Join(r.Form["tag"], ","))
+			count, err := c.purgeTags(prefix, tags)
+			if err != nil {
+				c.logger.Error("area", "cache", "tag", "purge", "tags", strings.Join(tags, ","), "error", err)
+				http.Error(w, "purge failed", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "purged %d files\n", count)
+			return
 		}
 
+		count, err := c.purgePrefix(prefix)
+		if err != nil {
+			c.logger.Error("area", "cache", "tag", "purge", "prefix", prefix, "error", err)
+			http.Error(w, "purge failed", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "purged %d files\n", count)
 	}
 
 	var shrinker http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
-		target := 50 << 10 // TODO(bep) Take value from conf
-		if err := c.shrinkTo(int64(target)); err != nil {
+		target, err := shrinkTarget(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stats, err := c.shrinkTo(target)
+		if err != nil {
 			c.logger.Error("area", "cache", "tag", "shrink", "error", err)
+			http.Error(w, "shrink failed", http.StatusInternalServerError)
+			return
 		}
+
+		fmt.Fprintf(w, "evicted %d files, %d bytes\n", stats.files, stats.bytes)
+	}
+
+	var reconciler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		stats, err := c.reconcile()
+		if err != nil {
+			c.logger.Error("area", "cache", "tag", "reconcile", "error", err)
+			http.Error(w, "reconcile failed", http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintln(w, stats)
 	}
 
 	var (
@@ -84,10 +133,12 @@ func NewServer(cfg Config, logger *Logger) (*Server, error) {
 
 	h.Handle(fmt.Sprintf("/%s/purge", appNS), secure(validateSig(purger)))
 	h.Handle(fmt.Sprintf("/%s/shrink", appNS), secure(validateSig(shrinker)))
+	h.Handle(fmt.Sprintf("/%s/reconcile", appNS), secure(validateSig(reconciler)))
 	h.Handle("/", secure(mw.serveFile()))
 
 	tlsEnabled, err := cfg.isTLSConfigured()
 	if err != nil {
+		c.close()
 		return nil, err
 	}
 
@@ -111,10 +162,13 @@ func NewServer(cfg Config, logger *Logger) (*Server, error) {
 		}
 	}
 
-	return &Server{cfg: cfg, logger: logger, server: s, tlsEnabled: tlsEnabled}, nil
+	return &Server{cfg: cfg, logger: logger, cache: c, server: s, tlsEnabled: tlsEnabled, done: make(chan struct{})}, nil
 }
 
 func (s *Server) Serve() error {
+	s.wg.Add(1)
+	go s.maintainCache()
+
 	s.logger.Info("Listener", s.cfg.ServerAddr)
 	if s.tlsEnabled {
 		return s.server.ListenAndServeTLS("", "")
@@ -123,17 +177,120 @@ func (s *Server) Serve() error {
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.server.Shutdown(ctx)
+	err := s.server.Shutdown(ctx)
+
+	close(s.done)
+	s.wg.Wait()
+
+	if cerr := s.cache.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// maintainCache reconciles the cache with the files on disk and keeps it
+// within the configured limits. These are checked periodically and after
+// cache fills.
+func (s *Server) maintainCache() {
+	defer s.wg.Done()
+
+	interval := durationOrDefault(s.cfg.MaintenanceInterval, time.Minute)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	enforce := func(recount bool) {
+		if _, err := s.cache.enforceLimits(recount); err != nil {
+			s.logger.Error("area", "cache", "tag", "maintenance", "error", err)
+		}
+	}
+
+	// Clean up after the last run.
+	if _, err := s.cache.reconcile(); err != nil {
+		s.logger.Error("area", "cache", "tag", "reconcile", "error", err)
+	}
+
+	enforce(true)
+
+	for {
+		select {
+		case <-ticker.C:
+			enforce(true)
+		case <-s.cache.filled:
+			enforce(false)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// shrinkTarget reads the target from the shrink request. If none is given,
+// the configured low watermark is used.
+func shrinkTarget(cfg Config, r *http.Request) (cacheLimits, error) {
+	var target cacheLimits
+
+	if v := r.FormValue("target"); v != "" {
+		size, err := parseByteSize(v)
+		if err != nil {
+			return target, err
+		}
+		target.size = size
+	}
+
+	if v := r.FormValue("files"); v != "" {
+		files, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || files < 0 {
+			return target, fmt.Errorf("invalid file count %q", v)
+		}
+		target.files = files
+	}
+
+	if target.isZero() {
+		_, target = cfg.watermarks()
+	}
+
+	if target.isZero() {
+		return target, errors.New("no target given and no cache limits configured")
+	}
+
+	return target, nil
 }
 
 func (m *httpHandlers) serveFile() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
 		// TODO containsDotDot https://github.com/golang/go/blob/f9cf8e5ab11c7ea3f1b9fde302c0a325df020b1a/src/net/http/fs.go#L665
-		err := m.c.handleRequest(w, r)
-		if err != nil {
-			m.c.logger.Error("handleRequest", err)
-			// TODO(bep) status code/err handling
+		tw := &trackingResponseWriter{ResponseWriter: w}
+		if err := m.c.handleRequest(tw, r); err != nil {
+			m.serveError(tw, r, err)
 		}
 	}
 }
+
+// serveError responds with the status code for err, unless the response
+// has already been started.
+func (m *httpHandlers) serveError(w *trackingResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+
+	if status >= http.StatusInternalServerError {
+		m.c.logger.Error("area", "server", "path", r.URL.Path, "status", status, "error", err)
+	} else {
+		m.c.logger.Debug("area", "server", "path", r.URL.Path, "status", status, "error", err)
+	}
+
+	if w.wroteHeader {
+		return
+	}
+
+	if host, found := m.c.cfg.host(r.Host); found && m.c.serveErrorPage(w, r, host, status) {
+		return
+	}
+
+	http.Error(w, http.StatusText(status), status)
+}
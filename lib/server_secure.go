@@ -37,13 +37,12 @@ func (m *httpHandlers) validateSig(h http.Handler) http.Handler {
 
 		verified, err := sig.VerifyURL(fullURL, r.Method)
 		m.c.logger.Debug("area", "sig", "url", fullURL, "verified", verified, "err", err)
-		// TODO(bep) status codes handling for the below.
-		if !verified {
-			return
-		}
-
 		if err != nil {
 			m.c.logger.Error("area", "sig", "error", err)
+		}
+
+		if !verified || err != nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
 
@@ -0,0 +1,77 @@
+// Copyright © 2017 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShrinkTarget(t *testing.T) {
+	assert := require.New(t)
+
+	target := func(cfg Config, query string) (cacheLimits, error) {
+		return shrinkTarget(cfg, httptest.NewRequest("GET", "http://example.org/__s3p/shrink"+query, nil))
+	}
+
+	limited := Config{MaxCacheSize: 1000, MaxCacheFiles: 10}
+
+	l, err := target(limited, "")
+	assert.NoError(err)
+	assert.Equal(cacheLimits{size: 900, files: 9}, l)
+
+	l, err = target(limited, "?target=1KB")
+	assert.NoError(err)
+	assert.Equal(cacheLimits{size: 1024}, l)
+
+	l, err = target(Config{}, "?target=100&files=5")
+	assert.NoError(err)
+	assert.Equal(cacheLimits{size: 100, files: 5}, l)
+
+	_, err = target(Config{}, "")
+	assert.Error(err)
+	_, err = target(limited, "?target=lots")
+	assert.Error(err)
+	_, err = target(limited, "?files=-1")
+	assert.Error(err)
+}
+
+func TestServeFileMethods(t *testing.T) {
+	assert := require.New(t)
+
+	s3 := &fakeS3{objects: map[string]string{"/index.html": "v1"}}
+
+	c, clean := newTestCache(t, s3)
+	defer clean()
+
+	h := (&httpHandlers{c: c}).serveFile()
+
+	for _, method := range []string{"POST", "PUT", "DELETE", "PATCH"} {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(method, "http://example.org/", nil))
+		assert.Equal(http.StatusMethodNotAllowed, rec.Code, method)
+		assert.Equal("GET, HEAD", rec.Header().Get("Allow"))
+	}
+
+	assert.Equal(int32(0), s3.requests)
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "http://example.org/", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("v1", rec.Body.String())
+}